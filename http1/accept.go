@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+type mediaRange struct {
+	typ, subtype string // lowercase, "*" for any
+	q            float64
+}
+
+// parseAccept returns the media ranges of an Accept value, in the order
+// listed. Malformed ranges and those of invalid q-value are dropped, the
+// parameters other than q are ignored.
+//
+//	text/html, application/json;q=0.9, */*;q=0.1
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, elem := range strings.Split(accept, ",") {
+		params := strings.Split(elem, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || typ == "" || subtype == "" || typ == "*" && subtype != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				q, ok = parseQValue(strings.TrimSpace(v))
+				break // what follows are extension parameters
+			}
+		}
+		if ok {
+			ranges = append(ranges, mediaRange{typ, subtype, q})
+		}
+	}
+	return ranges
+}
+
+// AcceptsMediaType returns the media type among offered the client prefers
+// according to its Accept header, the first offered on a tie or without an
+// Accept header, empty if the client accepts none of them.
+//
+// An offered type gets the q-value of the most specific media range matching
+// it, "text/html" over "text/*" over "*/*" (RFC 7231 section 5.3.2), a q of
+// 0 refusing it. Parameters such as charset are not compared.
+func (req *Request) AcceptsMediaType(offered ...string) string {
+	accept, ok := req.Header["Accept"]
+	if !ok {
+		if len(offered) == 0 {
+			return ""
+		}
+		return offered[0]
+	}
+	ranges := parseAccept(strings.Join(accept, ","))
+
+	qvalue := func(mediaType string) float64 {
+		mt, _, _ := strings.Cut(mediaType, ";")
+		typ, subtype, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mt)), "/")
+		q, specificity := 0.0, 0
+		for _, r := range ranges {
+			s := 0
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 3
+			case r.typ == typ && r.subtype == "*":
+				s = 2
+			case r.typ == "*":
+				s = 1
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		return q
+	}
+
+	best, bestQ := "", 0.0
+	for _, mt := range offered {
+		if q := qvalue(mt); q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	json, html := "application/json", "text/html"
+	tests := []struct {
+		accept []string // nil for no Accept header
+		want   string
+	}{
+		{nil, json},
+		{[]string{json}, json},
+		{[]string{html}, html},
+		{[]string{"text/html, application/json;q=0.9"}, html},
+		{[]string{"text/html;q=0.5, application/json"}, json},
+		{[]string{"text/html;q=0.5", "application/json;q=0.8"}, json},
+		{[]string{"*/*"}, json},
+		{[]string{"text/*"}, html},
+		{[]string{"*/*;q=0.1, text/html"}, html},
+		{[]string{"text/html;level=1;q=0.2, application/*;q=0.3"}, json},
+		{[]string{"TEXT/HTML"}, html},
+		// the most specific range wins, q=0 refusing
+		{[]string{"*/*, application/json;q=0"}, html},
+		{[]string{"text/*;q=0.9, text/html;q=0"}, ""},
+		{[]string{"image/png"}, ""},
+		{[]string{""}, ""},
+		{[]string{"text/html;q=2, application/json;q=0.1"}, json}, // invalid q-value dropped
+	}
+	for _, tt := range tests {
+		req := &Request{Header: make(http.Header)}
+		if tt.accept != nil {
+			req.Header["Accept"] = tt.accept
+		}
+		if got := req.AcceptsMediaType(json, html); got != tt.want {
+			t.Errorf("Accept %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	req := &Request{Header: http.Header{"Accept": {"text/html"}}}
+	if got := req.AcceptsMediaType("text/html; charset=utf-8"); got != "text/html; charset=utf-8" {
+		t.Errorf("offered with parameters: got %q", got)
+	}
+	if got := req.AcceptsMediaType(); got != "" {
+		t.Errorf("nothing offered: got %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AccessEntry describes a request served, for the access log.
+type AccessEntry struct {
+	RemoteAddr string
+	Method     string
+	RequestURI string
+	Proto      string
+	Status     int
+	Size       int // bytes of response body sent
+	Duration   time.Duration
+	RequestID  string // set by the RequestID middleware
+}
+
+// TextAccessLog formats e as
+//
+//	127.0.0.1:52044 "GET /index.html HTTP/1.1" 200 11 1.2ms
+//
+// An unknown remote address, as of Unix socket clients, is written "-". The
+// request ID, if any, comes last.
+func TextAccessLog(e AccessEntry) string {
+	remoteAddr := e.RemoteAddr
+	if remoteAddr == "" {
+		remoteAddr = "-"
+	}
+	line := fmt.Sprintf("%s %q %d %d %v",
+		remoteAddr, e.Method+" "+e.RequestURI+" "+e.Proto, e.Status, e.Size, e.Duration)
+	if e.RequestID != "" {
+		line += " " + e.RequestID
+	}
+	return line
+}
+
+// JSONAccessLog formats e as a JSON object.
+func JSONAccessLog(e AccessEntry) string {
+	b, err := json.Marshal(struct {
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		RequestURI string  `json:"request_uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Size       int     `json:"size"`
+		DurationMS float64 `json:"duration_ms"`
+		RequestID  string  `json:"request_id,omitempty"`
+	}{
+		e.RemoteAddr, e.Method, e.RequestURI, e.Proto,
+		e.Status, e.Size, float64(e.Duration) / float64(time.Millisecond),
+		e.RequestID,
+	})
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(b)
+}
+
+func (srv *Server) accessLog(req *Request, resp *Response, start time.Time) {
+	if srv.AccessLogFormat == nil {
+		return
+	}
+	srv.logger().Printf("%s", srv.AccessLogFormat(AccessEntry{
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		RequestURI: req.RequestURI,
+		Proto:      req.Proto,
+		Status:     resp.status,
+		Size:       resp.size,
+		Duration:   time.Since(start),
+		RequestID:  RequestIDFromContext(req.Context()),
+	}))
+}
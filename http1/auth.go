@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BasicAuth returns the credentials of the Authorization header when it uses
+// the Basic scheme.
+func (req *Request) BasicAuth() (username, password string, ok bool) {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(b), ":")
+	if !ok {
+		return "", "", false
+	}
+	return username, password, true
+}
+
+// RequireBasicAuth replies with a 401 Unauthorized asking for credentials of
+// realm with the Basic scheme.
+func (r *Response) RequireBasicAuth(realm string) {
+	r.WriteHeader("WWW-Authenticate", "Basic realm="+strconv.Quote(realm)+`, charset="UTF-8"`)
+	Error(r, "401 unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name, header       string
+		username, password string
+		ok                 bool
+	}{
+		{"valid", "Basic " + b64("aladdin:open sesame"), "aladdin", "open sesame", true},
+		{"scheme in another case", "BASIC " + b64("aladdin:open sesame"), "aladdin", "open sesame", true},
+		{"colon in the password", "Basic " + b64("aladdin:a:b"), "aladdin", "a:b", true},
+		{"empty password", "Basic " + b64("aladdin:"), "aladdin", "", true},
+		{"malformed base64", "Basic not*base64", "", "", false},
+		{"missing colon", "Basic " + b64("aladdin"), "", "", false},
+		{"other scheme", "Bearer " + b64("aladdin:open sesame"), "", "", false},
+		{"missing", "", "", "", false},
+	}
+	for _, tt := range tests {
+		req := &Request{Header: make(http.Header)}
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		username, password, ok := req.BasicAuth()
+		if username != tt.username || password != tt.password || ok != tt.ok {
+			t.Errorf("%s: BasicAuth() = %q, %q, %v, want %q, %q, %v", tt.name, username, password, ok, tt.username, tt.password, tt.ok)
+		}
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	var resp Response
+	resp.RequireBasicAuth(`my "realm"`)
+	if resp.status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.status)
+	}
+	if got, want := resp.header.Values("WWW-Authenticate"), `Basic realm="my \"realm\"", charset="UTF-8"`; len(got) != 1 || got[0] != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// transferDecoders decode the transfer codings the server supports besides
+// chunked (RFC 7230 section 4.2).
+var transferDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"x-gzip":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+}
+
+// transferCodings returns the transfer codings of the body of a request of
+// header h, in the order they were applied, such as gzip then chunked for
+// "gzip, chunked". The body of a request must end with the chunked coding,
+// once, for its length to be told (RFC 7230 section 3.3.3), a 400 Bad
+// Request otherwise; a coding the server can't decode gets a 501 Not
+// Implemented (RFC 7230 section 3.3.1).
+func transferCodings(h http.Header) ([]string, error) {
+	codings := headerTokens(h, "Transfer-Encoding")
+	for i, c := range codings {
+		c, _, _ = strings.Cut(c, ";") // parameters aren't used by any coding supported
+		c = strings.TrimSpace(c)
+		codings[i] = c
+		switch {
+		case c == "chunked" && i == len(codings)-1:
+		case c == "chunked":
+			return nil, statusError{http.StatusBadRequest, errors.New("chunked isn't the final transfer coding")}
+		case transferDecoders[c] == nil:
+			return nil, statusError{http.StatusNotImplemented, fmt.Errorf("unsupported transfer coding: %q", c)}
+		}
+	}
+	if len(codings) > 0 && codings[len(codings)-1] != "chunked" {
+		return nil, statusError{http.StatusBadRequest, errors.New("chunked isn't the final transfer coding")}
+	}
+	return codings, nil
+}
+
+// transferDecoder decodes a transfer coding applied before chunked. It is
+// set up on the first read, as setting it up reads the body, which a client
+// expecting a 100 Continue doesn't send before.
+type transferDecoder struct {
+	src    io.Reader // the body still coded
+	newDec func(io.Reader) (io.Reader, error)
+	dec    io.Reader
+	err    error
+}
+
+func (d *transferDecoder) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.dec == nil {
+		if d.dec, d.err = d.newDec(d.src); d.err != nil {
+			return 0, d.err
+		}
+	}
+	n, err := d.dec.Read(p)
+	if err == io.EOF {
+		// the coded data ends along with the body, whose framing is then
+		// read up to the next request
+		var b [1]byte
+		if _, serr := io.ReadFull(d.src, b[:]); serr != io.EOF {
+			if serr == nil {
+				serr = errors.New("data past the end of the coded body")
+			}
+			err = serr
+		}
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// chunkedReader decodes a body sent with the chunked transfer coding:
+//
+//	chunk-size [ ";" chunk-ext ] CRLF
+//	chunk-data CRLF
+//	...
+//	0 CRLF
+//	*( trailer-field CRLF )
+//	CRLF
+type chunkedReader struct {
+	r   *bufio.Reader
+	srv *Server // bounding the trailer section
+	n   uint64  // unread bytes of the current chunk
+	err error
+}
+
+func newChunkedReader(r *bufio.Reader, srv *Server) *chunkedReader {
+	return &chunkedReader{r: r, srv: srv}
+}
+
+func (cr *chunkedReader) Read(p []byte) (n int, err error) {
+	for cr.n == 0 && cr.err == nil {
+		cr.beginChunk()
+	}
+	if cr.n == 0 {
+		return 0, cr.err
+	}
+
+	if uint64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err = cr.r.Read(p)
+	cr.n -= uint64(n)
+	if cr.n == 0 && err == nil {
+		err = cr.readCRLF()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+func (cr *chunkedReader) beginChunk() {
+	line, err := readLine(cr.r)
+	if err != nil {
+		cr.err = err
+		return
+	}
+
+	size, _, ext := strings.Cut(line, ";") // chunk extensions are ignored
+	if ext {
+		// the only whitespace allowed, before the extensions (RFC 7230
+		// section 4.1.1)
+		size = strings.TrimRight(size, " \t")
+	}
+	// nothing but hex digits, a proxy in front reading a size the server
+	// doesn't would frame the body differently
+	if !isHex(size) {
+		cr.err = fmt.Errorf("invalid chunk size: %q", line)
+		return
+	}
+	cr.n, err = strconv.ParseUint(size, 16, 63)
+	if err != nil {
+		cr.n = 0 // ParseUint returns the largest size when out of range
+		cr.err = fmt.Errorf("invalid chunk size: %q", line)
+		return
+	}
+	if cr.n == 0 {
+		// last chunk, consume the trailer section up to the empty line
+		if _, err := parseMIMEHeader(cr.srv.newHeadReader(cr.r)); err != nil {
+			cr.err = fmt.Errorf("parse trailer: %w", err)
+			return
+		}
+		cr.err = io.EOF
+	}
+}
+
+// isHex reports whether s is a non-empty run of hex digits.
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if b := s[i]; !('0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *chunkedReader) readCRLF() error {
+	line, err := readLine(cr.r)
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return errors.New("missing CRLF after chunk data")
+	}
+	return nil
+}
+
+// maxChunkLineBytes bounds the chunk size lines, extensions included, and
+// the end of chunk data.
+const maxChunkLineBytes = 4 << 10
+
+// readLine reads a line of the chunked framing from r without its line
+// terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := readStringLimit(r, maxChunkLineBytes)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	line, _ = trimEOL(line)
+	return line, nil
+}
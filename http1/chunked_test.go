@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestChunkedReader(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+		ok               bool
+	}{
+		{"chunks", "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "hello world", true},
+		{"upper case size", "B\r\nhello world\r\n0\r\n\r\n", "hello world", true},
+		{"extension", "5;name=value\r\nhello\r\n0\r\n\r\n", "hello", true},
+		{"whitespace before an extension", "5 \t;name\r\nhello\r\n0\r\n\r\n", "hello", true},
+		{"trailer", "5\r\nhello\r\n0\r\nX-Checksum: 1\r\n\r\n", "hello", true},
+		{"space before the size", " 5\r\nhello\r\n0\r\n\r\n", "", false},
+		{"space after the size", "5 \r\nhello\r\n0\r\n\r\n", "", false},
+		{"hex prefix", "0x5\r\nhello\r\n0\r\n\r\n", "", false},
+		{"sign", "+5\r\nhello\r\n0\r\n\r\n", "", false},
+		{"empty size", "\r\nhello\r\n0\r\n\r\n", "", false},
+		{"size overflowing", "8000000000000000\r\nhello\r\n", "", false},
+		{"data past the size", "3\r\nhello\r\n0\r\n\r\n", "hel", false},
+		{"cut short", "5\r\nhel", "hel", false},
+		{"no last chunk", "5\r\nhello\r\n", "hello", false},
+	}
+	for _, tt := range tests {
+		cr := newChunkedReader(bufio.NewReader(strings.NewReader(tt.body)), NewServer("", nil))
+		b, err := ioutil.ReadAll(cr)
+		if string(b) != tt.want || (err == nil) != tt.ok {
+			t.Errorf("%s: got %q, %v, want %q and ok %v", tt.name, b, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client. When the request comes from
+// one of trustedProxies, given as IP addresses or CIDR ranges, that is the
+// address the proxies forwarded the request for, according to
+// X-Forwarded-For or X-Real-IP.
+//
+// X-Forwarded-For lists the addresses the request went through, each proxy
+// appending its peer. It is walked from the end, the first address not of a
+// trusted proxy is the client: what precedes it is up to the client to make
+// up.
+func (req *Request) ClientIP(trustedProxies ...string) string {
+	peer := parseIP(req.RemoteAddr)
+	if peer == nil {
+		return ""
+	}
+	trusted := parseTrustedProxies(trustedProxies)
+	if !isTrusted(trusted, peer) {
+		return peer.String()
+	}
+
+	if xff := req.Header["X-Forwarded-For"]; len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(hops[i])
+			if ip == nil {
+				break // can't tell where a malformed hop comes from
+			}
+			client = ip
+			if !isTrusted(trusted, ip) {
+				break
+			}
+		}
+		return client.String()
+	}
+	if ip := parseIP(req.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return peer.String()
+}
+
+// parseIP parses an IP address, with or without a port, IPv6 addresses
+// possibly in brackets.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, n)
+		} else if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets
+}
+
+func isTrusted(trusted []*net.IPNet, ip net.IP) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
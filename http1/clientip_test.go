@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		proxies    []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:52044", nil, trusted, "203.0.113.7"},
+		{"untrusted peer spoofing", "203.0.113.7:52044",
+			http.Header{"X-Forwarded-For": {"1.1.1.1"}, "X-Real-Ip": {"2.2.2.2"}}, trusted, "203.0.113.7"},
+		{"no trusted proxies", "10.0.0.1:80", http.Header{"X-Forwarded-For": {"1.1.1.1"}}, nil, "10.0.0.1"},
+		{"one hop", "10.0.0.1:80", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, trusted, "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 192.168.1.1", "10.1.2.3"}}, trusted, "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.1, 10.1.2.3"}}, trusted, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"10.9.9.9, 192.168.1.1"}}, trusted, "10.9.9.9"},
+		{"malformed hop", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, unknown, 10.1.2.3"}}, trusted, "10.1.2.3"},
+		{"hops with ports", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"198.51.100.1:4711, [2001:db8::1]:4711"}}, trusted, "2001:db8::1"},
+		{"IPv6 peer", "[fd00::1]:443",
+			http.Header{"X-Forwarded-For": {"[2001:db8::2]"}}, trusted, "2001:db8::2"},
+		{"untrusted IPv6 peer", "[2001:db8::3]:443", http.Header{"X-Forwarded-For": {"1.1.1.1"}}, trusted, "2001:db8::3"},
+		{"X-Real-IP", "10.0.0.1:80", http.Header{"X-Real-Ip": {"198.51.100.1"}}, trusted, "198.51.100.1"},
+		{"malformed X-Real-IP", "10.0.0.1:80", http.Header{"X-Real-Ip": {"unknown"}}, trusted, "10.0.0.1"},
+		{"X-Forwarded-For first", "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}}, trusted, "198.51.100.1"},
+		{"invalid proxies skipped", "10.0.0.1:80", http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			[]string{"proxy", "10.0.0.0/33", "", "10.0.0.1"}, "198.51.100.1"},
+		{"invalid proxies only", "10.0.0.1:80", http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			[]string{"proxy", "10.0.0.0/33"}, "10.0.0.1"},
+		{"no remote address", "", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, trusted, ""},
+	}
+	for _, tt := range tests {
+		req := &Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+		if got := req.ClientIP(tt.proxies...); got != tt.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
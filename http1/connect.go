@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connectTimeout bounds the time to connect to the host a tunnel is opened to.
+const connectTimeout = 10 * time.Second
+
+// connect answers a CONNECT request with a tunnel to the host it names when
+// srv.Proxy is set, with 405 Method Not Allowed otherwise. Once the tunnel is
+// established the bytes are copied both ways as they are, until either side
+// is done.
+func (srv *Server) connect(resp *Response, req *Request) {
+	if !srv.Proxy {
+		methodNotAllowed(resp, http.MethodConnect)
+		return
+	}
+
+	target, err := net.DialTimeout("tcp", req.Host, connectTimeout)
+	if err != nil {
+		srv.errorLog("connect to "+req.Host, err)
+		Error(resp, "502 bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, rw, err := resp.Hijack()
+	if err != nil {
+		srv.errorLog("hijack connection", err)
+		Error(resp, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the client may have sent past the request head already
+		_, _ = io.Copy(target, rw.Reader)
+		closeWrite(target)
+	}()
+	_, _ = io.Copy(conn, target)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite tells the peer of c nothing more is to be sent, when c can be
+// half-closed.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectDisabled(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		t.Errorf("CONNECT reached the handler")
+	}), nil)
+	resp := rawRequest(t, addr, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nConnection: close\r\n\r\n")
+	head, _ := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 405 Method Not Allowed" {
+		t.Errorf("status = %q, want 405", got)
+	}
+	if !strings.Contains(head, "\r\nAllow: DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT\r\n") {
+		t.Errorf("no Allow of the methods served:\n%s", head)
+	}
+
+	resp = rawRequest(t, addr, "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if got := statusLine(resp); got != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("CONNECT without a port: status = %q, want 400", got)
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	// the target echoes a line
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		c.Write([]byte("echo " + line))
+	}()
+	addr := startServer(t, nil, func(srv *Server) { srv.Proxy = true })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host := target.Addr().String()
+	// the first bytes for the target come along with the request
+	conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\nhello\n"))
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"HTTP/1.1 200 Connection Established\r\n", "\r\n", "echo hello\n"} {
+		if line, err := br.ReadString('\n'); line != want {
+			t.Fatalf("read %q, %v, want %q", line, err, want)
+		}
+	}
+}
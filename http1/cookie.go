@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Cookies parses the cookies sent with the request. Malformed pairs are
+// skipped.
+func (req *Request) Cookies() []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, line := range req.Header["Cookie"] {
+		for _, pair := range strings.Split(line, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !isToken(name) {
+				continue
+			}
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if !isCookieValue(value) {
+				continue
+			}
+			cookies = append(cookies, &http.Cookie{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// Cookie returns the first cookie named name sent with the request, or
+// http.ErrNoCookie.
+func (req *Request) Cookie(name string) (*http.Cookie, error) {
+	for _, c := range req.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, http.ErrNoCookie
+}
+
+// isCookieValue reports whether v is made of cookie-octets (RFC 6265).
+func isCookieValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		b := v[i]
+		if b <= ' ' || b >= 0x7f || b == '"' || b == ',' || b == ';' || b == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCookie adds a Set-Cookie header for c, each cookie on its own header
+// line. A cookie with an invalid name is dropped.
+func (r *Response) SetCookie(c *http.Cookie) {
+	if v := c.String(); v != "" {
+		r.WriteHeader("Set-Cookie", v)
+	}
+}
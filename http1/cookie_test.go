@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   map[string]string
+	}{
+		{"one header", []string{"a=1; b=2;c=3"}, map[string]string{"a": "1", "b": "2", "c": "3"}},
+		{"several headers", []string{"a=1; b=2", "c=3"}, map[string]string{"a": "1", "b": "2", "c": "3"}},
+		{"quoted value", []string{`a="quoted"; b=""`}, map[string]string{"a": "quoted", "b": ""}},
+		{"malformed pairs skipped", []string{`a=1; novalue; =2; b c=3; d="x y"; e=4`}, map[string]string{"a": "1", "e": "4"}},
+		{"none", nil, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Header: http.Header{"Cookie": tt.header}}
+			got := make(map[string]string)
+			for _, c := range req.Cookies() {
+				got[c.Name] = c.Value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cookies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookie(t *testing.T) {
+	req := &Request{Header: http.Header{"Cookie": {"a=1; b=2", "b=3"}}}
+	if c, err := req.Cookie("b"); err != nil || c.Value != "2" {
+		t.Errorf("Cookie(b) = %v, %v, want the first b", c, err)
+	}
+	if _, err := req.Cookie("c"); err != http.ErrNoCookie {
+		t.Errorf("Cookie(c) error = %v, want http.ErrNoCookie", err)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.SetCookie(&http.Cookie{Name: "session", Value: "abc", Path: "/", HttpOnly: true, Secure: true})
+		resp.SetCookie(&http.Cookie{Name: "theme", Value: "dark", MaxAge: 3600, SameSite: http.SameSiteLaxMode})
+		resp.SetCookie(&http.Cookie{Name: "bad name", Value: "x"})
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, _ := splitResponse(resp)
+	if n := strings.Count(head, "\r\nSet-Cookie: "); n != 2 {
+		t.Errorf("got %d Set-Cookie lines, want 2 without the invalid cookie:\n%s", n, head)
+	}
+	for _, want := range []string{
+		"\r\nSet-Cookie: session=abc; Path=/; HttpOnly; Secure\r\n",
+		"\r\nSet-Cookie: theme=dark; Max-Age=3600; SameSite=Lax\r\n",
+	} {
+		if !strings.Contains(head, want) {
+			t.Errorf("no %q:\n%s", strings.TrimSpace(want), head)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSOptions configures the cross-origin requests CORS allows.
+type CORSOptions struct {
+	AllowedOrigins []string // "*" allows any origin
+	AllowedMethods []string // GET, HEAD and POST when empty
+	AllowedHeaders []string // headers besides the CORS-safelisted ones
+
+	// AllowCredentials lets browsers send cookies and credentials along with
+	// the requests, and expose the responses. Browsers refuse the "*" origin
+	// then, an origin allowed by "*" is echoed instead.
+	AllowCredentials bool
+}
+
+// CORS serves cross-origin requests from the allowed origins with h, adding
+// the headers that let browsers expose the response. Preflight requests are
+// answered without calling h.
+func CORS(h Handler, opts CORSOptions) Handler {
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(opts.AllowedHeaders, ", ")
+
+	return HandlerFunc(func(resp *Response, req *Request) {
+		origin := req.Header.Get("Origin")
+		allowOrigin := corsAllowOrigin(opts.AllowedOrigins, origin, opts.AllowCredentials)
+		if allowOrigin != "*" {
+			// the response depends on the origin, even when it isn't allowed,
+			// and caches must not serve it for another one
+			resp.WriteHeader("Vary", "Origin")
+		}
+		if allowOrigin == "" {
+			h.ServeHTTP(resp, req)
+			return
+		}
+
+		resp.WriteHeader("Access-Control-Allow-Origin", allowOrigin)
+		if opts.AllowCredentials {
+			resp.WriteHeader("Access-Control-Allow-Credentials", "true")
+		}
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			resp.WriteHeader("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				resp.WriteHeader("Access-Control-Allow-Headers", allowHeaders)
+			}
+			resp.WriteStatus(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for origin,
+// empty if it isn't allowed. The "*" of allowed is given as origin itself
+// with credentials.
+func corsAllowOrigin(allowed []string, origin string, credentials bool) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range allowed {
+		if o == "*" && credentials {
+			return origin
+		}
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
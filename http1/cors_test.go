@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString("reached " + req.Method)
+	})
+	listed := CORSOptions{
+		AllowedOrigins: []string{"https://app.example"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Token"},
+	}
+	wildcard := CORSOptions{AllowedOrigins: []string{"*"}}
+	credentials := CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+
+	const preflight = "OPTIONS /items HTTP/1.1\r\nAccess-Control-Request-Method: PUT\r\n"
+	tests := []struct {
+		name   string
+		opts   CORSOptions
+		req    string // request line and header fields besides Host
+		status string
+		body   string
+		want   []string // all the CORS and Vary header fields, in any order
+	}{
+		{"preflight", listed, preflight + "Origin: https://app.example\r\n",
+			"204 No Content", "", []string{
+				"Access-Control-Allow-Origin: https://app.example",
+				"Access-Control-Allow-Methods: GET, PUT",
+				"Access-Control-Allow-Headers: Content-Type, X-Token",
+				"Vary: Origin",
+			}},
+		{"origin case", listed, "GET /items HTTP/1.1\r\nOrigin: HTTPS://APP.EXAMPLE\r\n",
+			"200 OK", "reached GET", []string{"Access-Control-Allow-Origin: HTTPS://APP.EXAMPLE", "Vary: Origin"}},
+		{"simple request", listed, "GET /items HTTP/1.1\r\nOrigin: https://app.example\r\n",
+			"200 OK", "reached GET", []string{"Access-Control-Allow-Origin: https://app.example", "Vary: Origin"}},
+		{"OPTIONS not a preflight", listed, "OPTIONS /items HTTP/1.1\r\nOrigin: https://app.example\r\n",
+			"200 OK", "reached OPTIONS", []string{"Access-Control-Allow-Origin: https://app.example", "Vary: Origin"}},
+		{"disallowed origin", listed, "GET /items HTTP/1.1\r\nOrigin: https://evil.example\r\n",
+			"200 OK", "reached GET", []string{"Vary: Origin"}},
+		{"disallowed preflight", listed, preflight + "Origin: https://evil.example\r\n",
+			"200 OK", "reached OPTIONS", []string{"Vary: Origin"}},
+		{"no origin", listed, "GET /items HTTP/1.1\r\n",
+			"200 OK", "reached GET", []string{"Vary: Origin"}},
+		{"wildcard", wildcard, "GET /items HTTP/1.1\r\nOrigin: https://any.example\r\n",
+			"200 OK", "reached GET", []string{"Access-Control-Allow-Origin: *"}},
+		{"wildcard preflight", wildcard, preflight + "Origin: https://any.example\r\n",
+			"204 No Content", "", []string{
+				"Access-Control-Allow-Origin: *",
+				"Access-Control-Allow-Methods: GET, HEAD, POST",
+			}},
+		{"wildcard with credentials", credentials, "GET /items HTTP/1.1\r\nOrigin: https://any.example\r\n",
+			"200 OK", "reached GET", []string{
+				"Access-Control-Allow-Origin: https://any.example",
+				"Access-Control-Allow-Credentials: true",
+				"Vary: Origin",
+			}},
+		{"preflight with credentials", credentials, preflight + "Origin: https://any.example\r\n",
+			"204 No Content", "", []string{
+				"Access-Control-Allow-Origin: https://any.example",
+				"Access-Control-Allow-Credentials: true",
+				"Access-Control-Allow-Methods: GET, HEAD, POST",
+				"Vary: Origin",
+			}},
+	}
+	for _, tt := range tests {
+		addr := startServer(t, CORS(h, tt.opts), nil)
+		line, rest, _ := strings.Cut(tt.req, "\r\n")
+		resp := rawRequest(t, addr, line+"\r\nHost: x\r\nConnection: close\r\n"+rest+"\r\n")
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != "HTTP/1.1 "+tt.status {
+			t.Errorf("%s: status line = %q, want %s", tt.name, got, tt.status)
+		}
+		if body != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+		var got []string
+		for _, field := range strings.Split(head, "\r\n")[1:] {
+			if strings.HasPrefix(field, "Access-Control-") || strings.HasPrefix(field, "Vary: ") {
+				got = append(got, field)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: CORS fields %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// compress encodes the buffered body with the content coding the client
+// prefers, gzip or deflate, when it is worth it. It is left as is when the
+// handler encoded it itself.
+func (r *Response) compress() {
+	// a partial content is a range of the unencoded content
+	if !r.srv.Compress || r.req == nil || len(r.data) < r.srv.CompressMinBytes || r.status == http.StatusPartialContent {
+		return
+	}
+	if r.header.Get("Content-Encoding") != "" || isCompressed(r.header.Get("Content-Type")) {
+		return
+	}
+	coding := negotiateEncoding(r.req.Header.Get("Accept-Encoding"), "gzip", "deflate")
+	if coding == "identity" {
+		return
+	}
+
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	switch coding {
+	case "gzip":
+		zw = gzip.NewWriter(&buf)
+	case "deflate":
+		// the zlib format, not a raw DEFLATE stream (RFC 7230 section 4.2.2)
+		zw = zlib.NewWriter(&buf)
+	}
+	if _, err := zw.Write(r.data); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	r.data = buf.Bytes()
+	r.WriteHeader("Content-Encoding", coding)
+	r.WriteHeader("Vary", "Accept-Encoding")
+}
+
+// acceptedEncoding is a content coding listed in Accept-Encoding, with its
+// q-value: from 1 for the most preferred down to 0 for refused.
+type acceptedEncoding struct {
+	coding string // lowercase, "*" standing for the codings not listed
+	q      float64
+}
+
+// parseAcceptEncoding returns the content codings of an Accept-Encoding
+// value from the most preferred to the least, those of the same q-value in
+// the order listed. Elements of invalid q-value are dropped.
+//
+//	gzip;q=0.5, deflate;q=0.9, br  =>  br, deflate (0.9), gzip (0.5)
+func parseAcceptEncoding(acceptEncoding string) []acceptedEncoding {
+	var accepted []acceptedEncoding
+	for _, elem := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(elem, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q, ok := 1.0, true
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				q, ok = parseQValue(strings.TrimSpace(v))
+				break // what follows are extension parameters
+			}
+		}
+		if ok {
+			accepted = append(accepted, acceptedEncoding{coding, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	return accepted
+}
+
+// parseQValue parses a q-value, a number from 0 to 1 with up to three
+// decimals (RFC 7231 section 5.3.1).
+func parseQValue(s string) (float64, bool) {
+	if len(s) == 0 || len(s) > 5 || s[0] != '0' && s[0] != '1' {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// negotiateEncoding returns the content coding among supported the client
+// prefers according to acceptEncoding, the first supported on a tie, or
+// "identity" when the client prefers no coding, accepts none of them, or
+// sent no Accept-Encoding.
+//
+// A coding not listed is accepted with the q-value of "*" if any, identity
+// being only chosen over the others when listed explicitly or through "*".
+func negotiateEncoding(acceptEncoding string, supported ...string) string {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	qvalue := func(coding string) float64 {
+		for _, a := range accepted {
+			if a.coding == coding {
+				return a.q
+			}
+		}
+		for _, a := range accepted {
+			if a.coding == "*" {
+				return a.q
+			}
+		}
+		return 0
+	}
+
+	best, bestQ := "identity", qvalue("identity")
+	for _, coding := range supported {
+		if q := qvalue(coding); q > 0 && q >= bestQ && (best == "identity" || q > bestQ) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// isCompressed reports whether the media type of contentType is compressed
+// already, compressing it again would only waste time.
+func isCompressed(contentType string) bool {
+	mt, _, _ := strings.Cut(contentType, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	if strings.HasPrefix(mt, "image/") && mt != "image/svg+xml" ||
+		strings.HasPrefix(mt, "audio/") ||
+		strings.HasPrefix(mt, "video/") {
+		return true
+	}
+	switch mt {
+	case "application/gzip", "application/x-gzip", "application/zip",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+		"application/zstd", "font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
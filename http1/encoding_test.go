@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("hello, compressed world\n", 100)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		switch req.Path {
+		case "/png":
+			resp.WriteHeader("Content-Type", "image/png")
+		case "/encoded":
+			resp.WriteHeader("Content-Encoding", "br")
+		case "/small":
+			resp.WriteString("small")
+			return
+		}
+		resp.WriteString(text)
+	}), nil)
+
+	get := func(path, acceptEncoding string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// set by hand, the transport leaves the body encoded
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("/", "gzip")
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %s, want the %d bytes compressed", got, len(body))
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := ioutil.ReadAll(zr); err != nil || string(plain) != text {
+		t.Errorf("decompressed body = %q, %v, want the text", plain, err)
+	}
+
+	tests := []struct {
+		name, path, acceptEncoding, encoding string
+	}{
+		{"not accepted", "/", "identity", ""},
+		{"refused", "/", "gzip;q=0", ""},
+		{"compressed type", "/png", "gzip", ""},
+		{"encoded by the handler", "/encoded", "gzip", "br"},
+		{"below the threshold", "/small", "gzip", ""},
+	}
+	for _, tt := range tests {
+		resp, _ := get(tt.path, tt.acceptEncoding)
+		if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", tt.name, got, tt.encoding)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding, want string
+	}{
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate;q=0.9", "deflate"},
+		{"GZIP;Q=0.5, Deflate;q=1.0", "deflate"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"identity", "identity"},
+		{"identity, gzip;q=0.5", "identity"},
+		{"*", "gzip"},
+		{"*;q=0", "identity"},
+		{"br", "identity"},
+		{"gzip;q=2, deflate;q=0.1", "deflate"},
+		{"", "identity"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding, "gzip", "deflate"); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           []acceptedEncoding
+	}{
+		{"gzip;q=0.5, deflate;q=0.9, br", []acceptedEncoding{{"br", 1}, {"deflate", 0.9}, {"gzip", 0.5}}},
+		// a q parameter ends the parameters of the coding
+		{"gzip;q=0.5;q=1", []acceptedEncoding{{"gzip", 0.5}}},
+		{"gzip;q=0.5;ext=q=1", []acceptedEncoding{{"gzip", 0.5}}},
+		{"gzip;ext=1;q=0.5", []acceptedEncoding{{"gzip", 0.5}}},
+		{"gzip;q=0", []acceptedEncoding{{"gzip", 0}}},
+		{"*;q=0, gzip", []acceptedEncoding{{"gzip", 1}, {"*", 0}}},
+		{"GZip;Q=0.8, DEFLATE", []acceptedEncoding{{"deflate", 1}, {"gzip", 0.8}}},
+		{" gzip ; q = 0.5 ", []acceptedEncoding{{"gzip", 0.5}}},
+		{"gzip, deflate", []acceptedEncoding{{"gzip", 1}, {"deflate", 1}}},
+		{"gzip;q=1.000, deflate;q=0.001", []acceptedEncoding{{"gzip", 1}, {"deflate", 0.001}}},
+		// invalid q-values drop the coding
+		{"gzip;q=1.5, deflate", []acceptedEncoding{{"deflate", 1}}},
+		{"gzip;q=2", nil},
+		{"gzip;q=-0.5", nil},
+		{"gzip;q=0.0001", nil},
+		{"gzip;q=abc", nil},
+		{"gzip;q=", nil},
+		{"gzip;q=.5", nil},
+		{", ,", nil},
+	}
+	for _, tt := range tests {
+		if got := parseAcceptEncoding(tt.acceptEncoding); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompressDeflate(t *testing.T) {
+	text := strings.Repeat("hello, deflated world\n", 100)
+	srv := NewServer("", nil)
+	resp := Response{req: &Request{Method: http.MethodGet, Header: http.Header{"Accept-Encoding": {"gzip;q=0.5, deflate"}}}, srv: srv}
+	resp.WriteString(text)
+	resp.prepare()
+	if got := resp.header.Get("Content-Encoding"); got != "deflate" {
+		t.Fatalf("Content-Encoding = %q, want deflate", got)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(resp.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := ioutil.ReadAll(zr); err != nil || string(plain) != text {
+		t.Errorf("inflated body = %q, %v, want the text", plain, err)
+	}
+}
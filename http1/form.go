@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+// ParseForm fills req.Form with the parameters of an
+// application/x-www-form-urlencoded body followed by those of the query, the
+// body is read only once.
+func (req *Request) ParseForm() error {
+	if req.Form != nil {
+		return nil
+	}
+
+	form := make(url.Values)
+	var err error
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		var b []byte
+		if b, err = ioutil.ReadAll(req.Body); err == nil {
+			var values url.Values
+			values, err = url.ParseQuery(string(b))
+			copyValues(form, values)
+		}
+	}
+	copyValues(form, req.Query())
+
+	req.Form = form
+	return err
+}
+
+// FormValue returns the first value of the form parameter name, parsing the
+// form if needed.
+func (req *Request) FormValue(name string) string {
+	if req.Form == nil {
+		if err := req.ParseForm(); err != nil {
+			req.srv.errorLog("parse form", err)
+		}
+	}
+	return req.Form.Get(name)
+}
+
+func copyValues(dst, src url.Values) {
+	for k, vs := range src {
+		dst[k] = append(dst[k], vs...)
+	}
+}
+
+// ErrNotMultipart is returned for requests that aren't multipart/form-data.
+var ErrNotMultipart = errors.New("request Content-Type isn't multipart/form-data")
+
+// MultipartReader returns a reader of the parts of a multipart/form-data body.
+func (req *Request) MultipartReader() (*multipart.Reader, error) {
+	mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, errors.New("no multipart boundary")
+	}
+	return multipart.NewReader(req.Body, boundary), nil
+}
+
+// ParseMultipartForm reads a multipart/form-data body into req.MultipartForm,
+// keeping up to maxMem bytes of files in memory and the rest in temporary
+// files removed once the request is served. The values of the parts are
+// added to req.Form as well.
+func (req *Request) ParseMultipartForm(maxMem int64) error {
+	if req.MultipartForm != nil {
+		return nil
+	}
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return err
+	}
+	form, err := mr.ReadForm(maxMem)
+	if err != nil {
+		return err
+	}
+	copyValues(req.Form, form.Value)
+	req.MultipartForm = form
+	if req.body != nil {
+		req.body.forms = append(req.body.forms, form)
+	}
+	return nil
+}
+
+// defaultMaxMemory is the memory FormFile lets files take when it parses the
+// multipart form itself.
+const defaultMaxMemory = 32 << 20
+
+// ErrMissingFile is returned by FormFile when there is no file of the name.
+var ErrMissingFile = errors.New("no such file in the multipart form")
+
+// FormFile returns the first file uploaded as the form field name, parsing
+// the multipart form if needed. The file is to be closed by the caller.
+func (req *Request) FormFile(name string) (multipart.File, *multipart.FileHeader, error) {
+	if req.MultipartForm == nil {
+		if err := req.ParseMultipartForm(defaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+	fhs := req.MultipartForm.File[name]
+	if len(fhs) == 0 {
+		return nil, nil, ErrMissingFile
+	}
+	f, err := fhs[0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, fhs[0], nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postFile posts content as the file field of a multipart/form-data body,
+// along with a name field, and returns the body of the response.
+func postFile(t *testing.T, url, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("name", "gopher")
+	fw, err := mw.CreateFormFile("file", "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	resp, err := http.Post(url, mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseForm(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if err := req.ParseForm(); err != nil {
+			if err != ErrBodyTooLarge {
+				t.Errorf("ParseForm: %v", err)
+			}
+			return // the server replies with a 413
+		}
+		fmt.Fprintf(resp, "%v first=%q", req.Form, req.FormValue("a"))
+	}), func(srv *Server) { srv.MaxBodyBytes = 16 })
+
+	const form = "Content-Type: application/x-www-form-urlencoded\r\n"
+	tests := []struct {
+		name, req, want string
+	}{
+		{"body and query", "POST /?a=3&c=4 HTTP/1.1\r\nHost: x\r\n" + form + "Content-Length: 12\r\n\r\na=1&b=x+y%21",
+			`map[a:[1 3] b:[x y!] c:[4]] first="1"`},
+		{"charset parameter", "POST / HTTP/1.1\r\nHost: x\r\nContent-Type: application/x-www-form-urlencoded; charset=utf-8\r\nContent-Length: 3\r\n\r\na=1",
+			`map[a:[1]] first="1"`},
+		{"empty body", "POST /?a=1 HTTP/1.1\r\nHost: x\r\n" + form + "Content-Length: 0\r\n\r\n",
+			`map[a:[1]] first="1"`},
+		{"no body", "POST / HTTP/1.1\r\nHost: x\r\n" + form + "\r\n",
+			`map[] first=""`},
+		{"other content type", "POST /?a=1 HTTP/1.1\r\nHost: x\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\nb=2",
+			`map[a:[1]] first="1"`},
+		{"too large", "POST / HTTP/1.1\r\nHost: x\r\n" + form + "Transfer-Encoding: chunked\r\n\r\n" +
+			"a\r\na=1&b=2&c=\r\na\r\n3&d=4&e=5&\r\n0\r\n\r\n",
+			"413 request entity too large\n"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, strings.Replace(tt.req, "\r\n\r\n", "\r\nConnection: close\r\n\r\n", 1))
+		_, body := splitResponse(resp)
+		if body != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, body, tt.want)
+		}
+	}
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	// files past maxMem are kept in temporary files
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	mux := NewServeMux()
+	mux.Handle("/upload/", StripPrefix("/upload", HandlerFunc(func(resp *Response, req *Request) {
+		if err := req.ParseMultipartForm(16); err != nil {
+			Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, fh, err := req.FormFile("file")
+		if err != nil {
+			Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f)
+		resp.Writef("%s %s %s", req.FormValue("name"), fh.Filename, b)
+	})))
+	addr := startServer(t, mux, nil)
+
+	for _, content := range []string{"hello", strings.Repeat("large file ", 100)} {
+		want := "gopher hello.txt " + content
+		if got := postFile(t, "http://"+addr+"/upload/", content); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if files, _ := ioutil.ReadDir(tmp); len(files) > 0 {
+			t.Errorf("temporary file %s left behind", files[0].Name())
+		}
+	}
+}
+
+func TestFormFile(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		// the form is parsed by FormFile
+		if _, _, err := req.FormFile("missing"); err != ErrMissingFile {
+			Error(resp, fmt.Sprintf("FormFile of a missing field: %v", err), http.StatusBadRequest)
+			return
+		}
+		f, fh, err := req.FormFile("file")
+		if err != nil {
+			Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f)
+		resp.Writef("%s %s", fh.Filename, b)
+	}), nil)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range []string{"first.txt", "second.txt"} {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("content of " + name))
+	}
+	mw.Close()
+	resp, err := http.Post("http://"+addr+"/", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if want := "first.txt content of first.txt"; string(b) != want {
+		t.Errorf("got %d %q, want the first file %q", resp.StatusCode, b, want)
+	}
+}
+
+func TestMultipartReader(t *testing.T) {
+	req := &Request{Header: http.Header{"Content-Type": {"text/plain"}}}
+	if _, err := req.MultipartReader(); err != ErrNotMultipart {
+		t.Errorf("MultipartReader of text/plain: %v, want ErrNotMultipart", err)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data")
+	if _, err := req.MultipartReader(); err == nil {
+		t.Error("MultipartReader without a boundary: no error")
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("a", "1")
+	mw.Close()
+	req = &Request{Header: http.Header{"Content-Type": {mw.FormDataContentType()}}, Body: ioutil.NopCloser(&buf)}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(p); p.FormName() != "a" || string(b) != "1" {
+		t.Errorf("part %s = %q, want a = 1", p.FormName(), b)
+	}
+}
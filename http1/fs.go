@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fileHandler struct {
+	root string
+}
+
+// FileServer serves the files of the directory tree rooted at root, the
+// request path naming the file relative to root. A directory is served with
+// its index.html.
+func FileServer(root string) Handler {
+	return &fileHandler{root}
+}
+
+func (f *fileHandler) ServeHTTP(resp *Response, req *Request) {
+	p := req.Path
+	if containsDotDot(p) {
+		Error(resp, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+
+	name := filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+p)))
+	fi, err := os.Stat(name)
+	if err != nil {
+		fileError(resp, req, err)
+		return
+	}
+	if fi.IsDir() {
+		name = filepath.Join(name, "index.html")
+		if fi, err = os.Stat(name); err != nil || fi.IsDir() {
+			Error(resp, "403 forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		fileError(resp, req, err)
+		return
+	}
+	defer file.Close()
+	resp.WriteHeader("ETag", fileETag(fi))
+	resp.ServeContent(name, fi.ModTime(), file)
+}
+
+// ServeContent replies with content, answering conditional and range
+// requests as the file server does, for handlers to serve content of their
+// own. The Content-Type is taken from the extension of name, sniffed if
+// unknown, unless set already. modtime is sent as Last-Modified unless
+// zero, and the ETag the handler set, if any, is compared with
+// If-None-Match.
+//
+// The content is streamed to the client rather than buffered, right away
+// along with the head, so that the response can't be changed afterwards
+// and isn't compressed. Not a byte is read for HEAD requests.
+func (r *Response) ServeContent(name string, modtime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		r.srv.errorLog("serve content", err)
+		Error(r, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !modtime.IsZero() {
+		r.WriteHeader("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r.req, modtime, r.header.Get("ETag")) {
+		r.WriteStatus(http.StatusNotModified)
+		return
+	}
+
+	r.WriteHeader("Accept-Ranges", "bytes")
+	start, length, ranged, err := parseRange(r.req, size)
+	if err != nil {
+		r.WriteHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+		Error(r, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if !ranged {
+		start, length = 0, size
+	}
+
+	if _, ok := r.header["Content-Type"]; !ok {
+		ct := mime.TypeByExtension(filepath.Ext(name))
+		if ct == "" && size > 0 {
+			// the beginning of the whole content tells its type, not the range
+			var buf [sniffLen]byte
+			n := 0
+			if _, err = content.Seek(0, io.SeekStart); err == nil {
+				n, err = io.ReadFull(content, buf[:])
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				r.srv.errorLog("serve content", err)
+				Error(r, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+			ct = http.DetectContentType(buf[:n])
+		}
+		if ct != "" {
+			r.WriteHeader("Content-Type", ct)
+		}
+	}
+	if _, err := content.Seek(start, io.SeekStart); err != nil {
+		r.srv.errorLog("serve content", err)
+		Error(r, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	if ranged {
+		r.WriteStatus(http.StatusPartialContent)
+		r.WriteHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	} else {
+		r.WriteStatus(http.StatusOK)
+	}
+	if err := r.writeContent(content, length); err != nil {
+		r.srv.errorLog("serve content", err)
+		if !r.sent {
+			Error(r, "500 internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// fileETag is a weak entity tag of the file, changing along with its size
+// or modification time.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// notModified reports whether the client has the current copy of the content
+// tagged etag and last modified at modtime, according to If-None-Match or,
+// lacking it, If-Modified-Since. Either is left out when unknown, empty or
+// zero.
+func notModified(req *Request, modtime time.Time, etag string) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if inm := req.Header["If-None-Match"]; len(inm) > 0 {
+		return etag != "" && etagMatch(strings.Join(inm, ","), etag)
+	}
+	if modtime.IsZero() {
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// the header has a precision of a second
+	return !modtime.Truncate(time.Second).After(ims)
+}
+
+// etagMatch reports whether etag is in the If-None-Match list, compared
+// weakly as the weak tags make no difference for GET and HEAD.
+func etagMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+		if list[0] == '*' {
+			return true
+		}
+
+		list = strings.TrimPrefix(list, "W/")
+		if len(list) < 2 || list[0] != '"' {
+			return false // malformed
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if list[:end+2] == etag {
+			return true
+		}
+		list = list[end+2:]
+	}
+}
+
+var errUnsatisfiableRange = errors.New("416 range not satisfiable")
+
+// parseRange parses the single byte range a GET request asks for out of size
+// bytes, such as "bytes=0-499", "bytes=500-" or "bytes=-500" (the last 500
+// bytes). The full content is served when there is no range, or for ranges
+// this server doesn't handle: malformed ones, other units, several ranges.
+func parseRange(req *Request, size int64) (start, length int64, ok bool, err error) {
+	spec := req.Header.Get("Range")
+	if req.Method != http.MethodGet || !strings.HasPrefix(spec, "bytes=") {
+		return 0, 0, false, nil
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes="))
+	first, last, found := strings.Cut(spec, "-")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// suffix range
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+	return start, end - start + 1, true, nil
+}
+
+func fileError(resp *Response, req *Request, err error) {
+	switch {
+	case os.IsNotExist(err):
+		NotFound(resp, req)
+	case os.IsPermission(err):
+		Error(resp, "403 forbidden", http.StatusForbidden)
+	default:
+		resp.srv.errorLog("serve file", err)
+		Error(resp, "500 internal server error", http.StatusInternalServerError)
+	}
+}
+
+func containsDotDot(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileServer(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"style.css":       "body {}",
+		"docs/index.html": "<p>docs</p>",
+		"empty/.keep":     "",
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startServer(t, FileServer(dir), nil)
+
+	tests := []struct {
+		path, status, contentType, body string
+	}{
+		{"/style.css", "HTTP/1.1 200 OK", "text/css; charset=utf-8", "body {}"},
+		{"/docs/", "HTTP/1.1 200 OK", "text/html; charset=utf-8", "<p>docs</p>"},
+		{"/missing.css", "HTTP/1.1 404 Not Found", "text/plain; charset=utf-8", "404 page not found\n"},
+		// a directory without an index isn't listed
+		{"/empty/", "HTTP/1.1 403 Forbidden", "text/plain; charset=utf-8", "403 forbidden\n"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("GET %s: status = %q, want %q", tt.path, got, tt.status)
+		}
+		if !strings.Contains(head, "\r\nContent-Type: "+tt.contentType+"\r\n") {
+			t.Errorf("GET %s: no Content-Type of %s:\n%s", tt.path, tt.contentType, head)
+		}
+		if body != tt.body {
+			t.Errorf("GET %s: body = %q, want %q", tt.path, body, tt.body)
+		}
+	}
+}
+
+func TestFileServerTraversal(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "public.txt"), []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mux := NewServeMux()
+	mux.Handle("/static/", StripPrefix("/static", FileServer(root)))
+	addr := startServer(t, mux, nil)
+
+	tests := []struct {
+		path   string
+		status string
+	}{
+		// collapsed to a path outside of the file server
+		{"/static/../secret.txt", "HTTP/1.1 404 Not Found"},
+		{"/static/%2e%2e/secret.txt", "HTTP/1.1 404 Not Found"},
+		// climbing above the root
+		{"/static/../../secret.txt", "HTTP/1.1 400 Bad Request"},
+		{"/static/%2e%2e/%2e%2e/secret.txt", "HTTP/1.1 400 Bad Request"},
+		{"/static/%2E%2E%2F%2E%2E%2Fsecret.txt", "HTTP/1.1 400 Bad Request"},
+		{"/static/..%2f..%2fsecret.txt", "HTTP/1.1 400 Bad Request"},
+		{"/static/a/../../../secret.txt", "HTTP/1.1 400 Bad Request"},
+		{"/../secret.txt", "HTTP/1.1 400 Bad Request"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("GET %s: status = %q, want %q", tt.path, got, tt.status)
+		}
+		if strings.Contains(resp, "secret") {
+			t.Errorf("GET %s served the file out of the root", tt.path)
+		}
+	}
+
+	for _, p := range []string{"/static/public.txt", "/static/a/../public.txt", "/static/./%2e/public.txt"} {
+		resp := rawRequest(t, addr, "GET "+p+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if got := statusLine(resp); got != "HTTP/1.1 200 OK" || !strings.HasSuffix(resp, "\r\n\r\npublic") {
+			t.Errorf("GET %s = %q, want the public file", p, resp)
+		}
+	}
+}
+
+// serveFile serves a file of content last modified at modtime from its own
+// file server, and returns the address and the path of the file.
+func serveFile(t *testing.T, content string, modtime time.Time) (addr, path string) {
+	t.Helper()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	return startServer(t, FileServer(dir), nil), "/file.txt"
+}
+
+func TestFileServerIfModifiedSince(t *testing.T) {
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	addr, path := serveFile(t, "content", modtime)
+	lastModified := "Thu, 02 Jan 2020 03:04:05 GMT"
+
+	tests := []struct {
+		name, ims, status, body string
+	}{
+		{"unchanged", lastModified, "HTTP/1.1 304 Not Modified", ""},
+		{"unchanged since later", "Fri, 03 Jan 2020 00:00:00 GMT", "HTTP/1.1 304 Not Modified", ""},
+		{"changed since", "Wed, 01 Jan 2020 00:00:00 GMT", "HTTP/1.1 200 OK", "content"},
+		{"invalid date", "yesterday", "HTTP/1.1 200 OK", "content"},
+		{"none", "", "HTTP/1.1 200 OK", "content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := "GET " + path + " HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+			if tt.ims != "" {
+				req += "If-Modified-Since: " + tt.ims + "\r\n"
+			}
+			resp := rawRequest(t, addr, req+"\r\n")
+			head, body := splitResponse(resp)
+			if got := statusLine(resp); got != tt.status {
+				t.Errorf("status = %q, want %q", got, tt.status)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if !strings.Contains(head, "\r\nLast-Modified: "+lastModified+"\r\n") {
+				t.Errorf("no Last-Modified of %s:\n%s", lastModified, head)
+			}
+		})
+	}
+}
+
+func TestFileServerETag(t *testing.T) {
+	addr, path := serveFile(t, "content", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	resp := rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, _ := splitResponse(resp)
+	i := strings.Index(head, "\r\nEtag: ")
+	if i < 0 {
+		t.Fatalf("no ETag on the 200:\n%s", head)
+	}
+	etag := head[i+len("\r\nEtag: "):]
+	etag = etag[:strings.Index(etag, "\r\n")]
+
+	tests := []struct {
+		name, inm, status, body string
+	}{
+		{"same", etag, "HTTP/1.1 304 Not Modified", ""},
+		{"among others", `"other", ` + etag, "HTTP/1.1 304 Not Modified", ""},
+		{"strong form", strings.TrimPrefix(etag, "W/"), "HTTP/1.1 304 Not Modified", ""},
+		{"any", "*", "HTTP/1.1 304 Not Modified", ""},
+		{"other", `"other"`, "HTTP/1.1 200 OK", "content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\nHost: x\r\nIf-None-Match: "+tt.inm+"\r\n"+
+				// If-None-Match takes precedence
+				"If-Modified-Since: Wed, 01 Jan 2020 00:00:00 GMT\r\nConnection: close\r\n\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Errorf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestFileServerRange(t *testing.T) {
+	addr, path := serveFile(t, "0123456789", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	tests := []struct {
+		rng, status, contentRange, body string
+	}{
+		{"bytes=2-5", "HTTP/1.1 206 Partial Content", "bytes 2-5/10", "2345"},
+		{"bytes=7-", "HTTP/1.1 206 Partial Content", "bytes 7-9/10", "789"},
+		{"bytes=-3", "HTTP/1.1 206 Partial Content", "bytes 7-9/10", "789"},
+		{"bytes=5-100", "HTTP/1.1 206 Partial Content", "bytes 5-9/10", "56789"},
+		{"bytes=10-", "HTTP/1.1 416 Requested Range Not Satisfiable", "bytes */10", ""},
+		{"bytes=-0", "HTTP/1.1 416 Requested Range Not Satisfiable", "bytes */10", ""},
+		// served whole
+		{"bytes=0-1,4-5", "HTTP/1.1 200 OK", "", "0123456789"},
+		{"bytes=5-2", "HTTP/1.1 200 OK", "", "0123456789"},
+		{"lines=1-2", "HTTP/1.1 200 OK", "", "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rng, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\nHost: x\r\nRange: "+tt.rng+"\r\nConnection: close\r\n\r\n")
+			head, body := splitResponse(resp)
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if tt.contentRange != "" && !strings.Contains(head, "\r\nContent-Range: "+tt.contentRange+"\r\n") {
+				t.Errorf("no Content-Range of %s:\n%s", tt.contentRange, head)
+			}
+			if tt.status != "HTTP/1.1 416 Requested Range Not Satisfiable" {
+				if body != tt.body {
+					t.Errorf("body = %q, want %q", body, tt.body)
+				}
+				if !strings.Contains(head, "\r\nContent-Length: "+strconv.Itoa(len(tt.body))+"\r\n") {
+					t.Errorf("no Content-Length of %d:\n%s", len(tt.body), head)
+				}
+			}
+		})
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		switch req.Path {
+		case "/data.json":
+			resp.ServeContent("data.json", modtime, bytes.NewReader([]byte(`{"n":1234}`)))
+		case "/generated":
+			resp.ServeContent("generated", time.Time{}, strings.NewReader("<html>generated</html>"))
+		}
+	}), nil)
+
+	tests := []struct {
+		name, path, header, status, body string
+		want                             []string // header lines
+	}{
+		{"whole", "/data.json", "", "HTTP/1.1 200 OK", `{"n":1234}`,
+			[]string{"Content-Type: application/json", "Content-Length: 10", "Last-Modified: Thu, 02 Jan 2020 03:04:05 GMT", "Accept-Ranges: bytes"}},
+		{"range", "/data.json", "Range: bytes=5-8\r\n", "HTTP/1.1 206 Partial Content", "1234",
+			[]string{"Content-Range: bytes 5-8/10", "Content-Length: 4"}},
+		{"not modified", "/data.json", "If-Modified-Since: Thu, 02 Jan 2020 03:04:05 GMT\r\n", "HTTP/1.1 304 Not Modified", "", nil},
+		{"sniffed", "/generated", "", "HTTP/1.1 200 OK", "<html>generated</html>",
+			[]string{"Content-Type: text/html; charset=utf-8"}},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+tt.header+"\r\n")
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("%s: status line = %q, want %q", tt.name, got, tt.status)
+		}
+		if body != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+		for _, h := range tt.want {
+			if !strings.Contains(head, "\r\n"+h+"\r\n") {
+				t.Errorf("%s: no %s:\n%s", tt.name, h, head)
+			}
+		}
+	}
+}
+
+func TestFileServerDecodedPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a b.txt"), []byte("spaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, FileServer(dir), nil)
+	resp := rawRequest(t, addr, "GET /a%20b.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if _, body := splitResponse(resp); statusLine(resp) != "HTTP/1.1 200 OK" || body != "spaced" {
+		t.Errorf("GET /a%%20b.txt = %q, want the file", resp)
+	}
+}
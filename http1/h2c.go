@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With Server.H2C set, plaintext HTTP/1.1 connections switch to HTTP/2 when
+// the client asks to with "Upgrade: h2c" (RFC 7540 section 3.2).
+//
+// HTTP/2 is only sketched to show how the upgrade goes: the request carrying
+// the upgrade is answered over HTTP/2 as stream 1, then the connection is
+// closed with a GOAWAY, the client retrying its other requests on a new
+// connection. Of the frames the client sends:
+//   - SETTINGS are applied and acknowledged,
+//   - PING is answered,
+//   - WINDOW_UPDATE credits the flow-control windows the response is sent in,
+//   - RST_STREAM of stream 1 and GOAWAY stop the response,
+//   - HEADERS, CONTINUATION, DATA, PRIORITY and the others are ignored, the
+//     streams the client opens are never answered.
+//
+// Header blocks are encoded as HPACK literals, with neither Huffman coding nor
+// the dynamic table, and the client's are never decoded.
+
+// h2cUpgrade returns the HTTP/2 settings req carries when it asks to switch
+// to HTTP/2, reporting whether the switch can be made. Requests with a body
+// are served over HTTP/1.1, the body would otherwise have to be read before
+// switching.
+func (srv *Server) h2cUpgrade(req *Request) ([]byte, bool) {
+	if !srv.H2C || req.TLS != nil || req.Proto != "HTTP/1.1" {
+		return nil, false
+	}
+	if !headerHasToken(req.Header, "Upgrade", "h2c") ||
+		!req.hasConnectionToken("Upgrade") ||
+		!req.hasConnectionToken("HTTP2-Settings") ||
+		len(req.Header["Http2-Settings"]) != 1 {
+		return nil, false
+	}
+	if !req.body.empty() {
+		return nil, false
+	}
+	// the payload of a SETTINGS frame in base64url
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Header.Get("Http2-Settings"), "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
+
+// HTTP/2 frame types (RFC 7540 section 6).
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+// HTTP/2 frame flags.
+const (
+	flagAck        = 0x1 // SETTINGS and PING
+	flagEndStream  = 0x1 // DATA and HEADERS
+	flagEndHeaders = 0x4 // HEADERS and CONTINUATION
+)
+
+// HTTP/2 error codes (RFC 7540 section 7).
+const (
+	errCodeNo          = 0x0
+	errCodeProtocol    = 0x1
+	errCodeInternal    = 0x2
+	errCodeFlowControl = 0x3
+	errCodeFrameSize   = 0x6
+)
+
+// settingInitialWindow is the SETTINGS_INITIAL_WINDOW_SIZE identifier.
+const settingInitialWindow = 0x4
+
+const (
+	h2Preface       = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	h2MaxFrameSize  = 16384 // the default, not raised
+	h2InitialWindow = 65535
+)
+
+// h2Error is a connection error, the connection is closed with a GOAWAY
+// carrying code.
+type h2Error struct {
+	code uint32
+	err  error
+}
+
+func (e h2Error) Error() string { return e.err.Error() }
+
+func (e h2Error) Unwrap() error { return e.err }
+
+// errStreamStopped is returned sending the response the client doesn't want
+// anymore.
+var errStreamStopped = errors.New("stream stopped by the client")
+
+// h2Conn is a connection switched to HTTP/2, stream 1 being the upgraded
+// request.
+type h2Conn struct {
+	srv  *Server
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// flow-control windows of the client, bytes of DATA it is ready for
+	connWindow, streamWindow int64
+	initialWindow            int64
+}
+
+// serveH2C switches the connection of req to HTTP/2 and answers req over it,
+// then closes the HTTP/2 connection.
+func (srv *Server) serveH2C(conn net.Conn, r *bufio.Reader, w *bufio.Writer, req *Request, settings []byte) error {
+	start := time.Now()
+	h2 := &h2Conn{srv: srv, conn: conn, r: r, w: w, connWindow: h2InitialWindow, initialWindow: h2InitialWindow}
+	if err := h2.applySettings(settings); err != nil {
+		srv.writeError(w, req, http.StatusBadRequest, err)
+		return err
+	}
+	h2.streamWindow = h2.initialWindow
+
+	if _, err := w.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return err
+	}
+	// the server connection preface, no setting is changed from its default
+	if err := h2.writeFrame(frameSettings, 0, 0, nil); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := h2.readPreface(); err != nil {
+		return h2.close(err)
+	}
+
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	resp := Response{w: w, req: req, srv: srv}
+	if !srv.serve(&resp, req) {
+		resp = Response{w: w, req: req, srv: srv}
+		resp.WriteStatus(http.StatusInternalServerError)
+	}
+	if err := h2.writeResponse(&resp); err != nil {
+		return h2.close(err)
+	}
+	srv.accessLog(req, &resp, start)
+	return h2.close(nil)
+}
+
+// readPreface reads the client connection preface: the preface string
+// followed by a SETTINGS frame, acknowledged.
+func (h2 *h2Conn) readPreface() error {
+	if h2.srv.ReadTimeout > 0 {
+		if err := h2.conn.SetReadDeadline(time.Now().Add(h2.srv.ReadTimeout)); err != nil {
+			return err
+		}
+	}
+	preface := make([]byte, len(h2Preface))
+	if _, err := io.ReadFull(h2.r, preface); err != nil {
+		return err
+	}
+	if string(preface) != h2Preface {
+		return h2Error{errCodeProtocol, fmt.Errorf("invalid connection preface: %q", preface)}
+	}
+	typ, flags, _, payload, err := h2.readFrame()
+	if err != nil {
+		return err
+	}
+	if typ != frameSettings || flags&flagAck != 0 {
+		return h2Error{errCodeProtocol, fmt.Errorf("connection preface ended by frame type %d, not SETTINGS", typ)}
+	}
+	if err := h2.applySettings(payload); err != nil {
+		return err
+	}
+	if err := h2.writeFrame(frameSettings, flagAck, 0, nil); err != nil {
+		return err
+	}
+	return h2.conn.SetReadDeadline(time.Time{})
+}
+
+// applySettings applies the SETTINGS frame payload of the client. Only the
+// initial window size matters to the response, other settings are ignored.
+func (h2 *h2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return h2Error{errCodeFrameSize, errors.New("invalid SETTINGS frame size")}
+	}
+	for ; len(payload) > 0; payload = payload[6:] {
+		id, value := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint32(payload[2:])
+		if id != settingInitialWindow {
+			continue
+		}
+		if value > 1<<31-1 {
+			return h2Error{errCodeFlowControl, fmt.Errorf("invalid initial window size: %d", value)}
+		}
+		// the window of the open stream moves along (RFC 7540 section 6.9.2)
+		h2.streamWindow += int64(value) - h2.initialWindow
+		h2.initialWindow = int64(value)
+	}
+	return nil
+}
+
+// readFrame reads the next frame of the client.
+func (h2 *h2Conn) readFrame() (typ, flags byte, stream uint32, payload []byte, err error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(h2.r, hdr[:]); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	if length > h2MaxFrameSize {
+		return 0, 0, 0, nil, h2Error{errCodeFrameSize, fmt.Errorf("frame of %d bytes", length)}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(h2.r, payload); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	return hdr[3], hdr[4], binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1), payload, nil
+}
+
+// handleFrame handles a frame of the client read while the response waits
+// for its flow-control windows to open.
+func (h2 *h2Conn) handleFrame() error {
+	typ, flags, stream, payload, err := h2.readFrame()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case frameSettings:
+		if flags&flagAck != 0 {
+			return nil
+		}
+		if err := h2.applySettings(payload); err != nil {
+			return err
+		}
+		return h2.writeFrame(frameSettings, flagAck, 0, nil)
+	case framePing:
+		if len(payload) != 8 {
+			return h2Error{errCodeFrameSize, errors.New("invalid PING frame size")}
+		}
+		if flags&flagAck != 0 {
+			return nil
+		}
+		return h2.writeFrame(framePing, flagAck, 0, payload)
+	case frameWindowUpdate:
+		if len(payload) != 4 {
+			return h2Error{errCodeFrameSize, errors.New("invalid WINDOW_UPDATE frame size")}
+		}
+		increment := int64(binary.BigEndian.Uint32(payload) & (1<<31 - 1))
+		switch stream {
+		case 0:
+			h2.connWindow += increment
+		case 1:
+			h2.streamWindow += increment
+		}
+	case frameRSTStream:
+		if stream == 1 {
+			return errStreamStopped
+		}
+	case frameGoAway:
+		return errStreamStopped
+	}
+	return nil
+}
+
+// writeResponse sends resp on stream 1: a HEADERS frame, the body in DATA
+// frames, then the trailers in another HEADERS frame.
+func (h2 *h2Conn) writeResponse(resp *Response) error {
+	noBody := resp.prepare()
+	resp.addDefaultHeaders()
+
+	// :status is named by its index in the static table (RFC 7541 appendix A)
+	block := appendHpackString(appendHpackInt(nil, 4, 0x00, 8), fmt.Sprint(resp.status))
+	block = appendHpackHeader(block, resp.header, h2.srv.SortHeaders)
+	endStream := noBody || len(resp.data) == 0 && len(resp.trailer) == 0
+	if err := h2.writeHeaders(block, endStream); err != nil {
+		return err
+	}
+	if noBody {
+		return nil
+	}
+
+	if len(resp.data) > 0 {
+		if err := h2.writeData(resp.data, len(resp.trailer) == 0); err != nil {
+			return err
+		}
+		resp.size = len(resp.data)
+	}
+	if len(resp.trailer) > 0 {
+		return h2.writeHeaders(appendHpackHeader(nil, resp.trailer, h2.srv.SortHeaders), true)
+	}
+	return nil
+}
+
+// writeHeaders sends a header block on stream 1, in CONTINUATION frames past
+// what fits in the HEADERS frame.
+func (h2 *h2Conn) writeHeaders(block []byte, endStream bool) error {
+	typ, flags := byte(frameHeaders), byte(0)
+	if endStream {
+		flags = flagEndStream
+	}
+	for {
+		frag := block
+		if len(frag) > h2MaxFrameSize {
+			frag = frag[:h2MaxFrameSize]
+		}
+		block = block[len(frag):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		if err := h2.writeFrame(typ, flags, 1, frag); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		typ, flags = frameContinuation, 0
+	}
+}
+
+// writeData sends data on stream 1 in DATA frames as the flow-control windows
+// of the client allow, waiting for them to open when they are exhausted.
+func (h2 *h2Conn) writeData(data []byte, endStream bool) error {
+	for len(data) > 0 {
+		for h2.connWindow <= 0 || h2.streamWindow <= 0 {
+			if err := h2.w.Flush(); err != nil {
+				return err
+			}
+			if h2.srv.ReadTimeout > 0 {
+				if err := h2.conn.SetReadDeadline(time.Now().Add(h2.srv.ReadTimeout)); err != nil {
+					return err
+				}
+			}
+			if err := h2.handleFrame(); err != nil {
+				return err
+			}
+		}
+
+		n := int64(len(data))
+		if n > h2MaxFrameSize {
+			n = h2MaxFrameSize
+		}
+		if n > h2.connWindow {
+			n = h2.connWindow
+		}
+		if n > h2.streamWindow {
+			n = h2.streamWindow
+		}
+		flags := byte(0)
+		if endStream && n == int64(len(data)) {
+			flags = flagEndStream
+		}
+		if err := h2.writeFrame(frameData, flags, 1, data[:n]); err != nil {
+			return err
+		}
+		h2.connWindow -= n
+		h2.streamWindow -= n
+		data = data[n:]
+	}
+	return nil
+}
+
+func (h2 *h2Conn) writeFrame(typ, flags byte, stream uint32, payload []byte) error {
+	n := len(payload)
+	hdr := [9]byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags}
+	binary.BigEndian.PutUint32(hdr[5:], stream)
+	if _, err := h2.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := h2.w.Write(payload)
+	return err
+}
+
+// close ends the HTTP/2 connection with a GOAWAY telling the client stream 1
+// is the last one processed, with the error code of err. The connection is
+// closed by the caller.
+func (h2 *h2Conn) close(err error) error {
+	code := uint32(errCodeNo)
+	var he h2Error
+	switch {
+	case errors.As(err, &he):
+		code = he.code
+	case errors.Is(err, errStreamStopped):
+		err = nil
+	case err != nil:
+		code = errCodeInternal
+	}
+	var payload [8]byte
+	binary.BigEndian.PutUint32(payload[:], 1)
+	binary.BigEndian.PutUint32(payload[4:], code)
+	if werr := h2.writeFrame(frameGoAway, 0, 0, payload[:]); werr == nil {
+		_ = h2.w.Flush()
+	}
+	return err
+}
+
+// connectionHeaders are specific to HTTP/1.1 connections, HTTP/2 has no use
+// for them (RFC 7540 section 8.1.2.2).
+var connectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// appendHpackHeader appends the fields of h to an HPACK header block, each a
+// literal field without indexing (RFC 7541 section 6.2.2). HTTP/2 field names
+// are lowercase. The fields are sorted by name if asked to.
+func appendHpackHeader(block []byte, h http.Header, sorted bool) []byte {
+	eachHeader(h, sorted, func(k string, v []string) {
+		if connectionHeaders[k] {
+			return
+		}
+		for _, vv := range v {
+			block = append(block, 0x00) // new name, not indexed
+			block = appendHpackString(block, strings.ToLower(k))
+			block = appendHpackString(block, vv)
+		}
+	})
+	return block
+}
+
+// appendHpackString appends s as an HPACK string literal, without Huffman
+// coding (RFC 7541 section 5.2).
+func appendHpackString(block []byte, s string) []byte {
+	return append(appendHpackInt(block, 7, 0x00, uint64(len(s))), s...)
+}
+
+// appendHpackInt appends v as an HPACK integer with an n-bit prefix, the
+// higher bits of the first byte being those of first (RFC 7541 section 5.1).
+func appendHpackInt(block []byte, n uint, first byte, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(block, first|byte(v))
+	}
+	block = append(block, first|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		block = append(block, byte(v)|0x80)
+	}
+	return append(block, byte(v))
+}
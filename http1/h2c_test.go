@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2Frame is a frame read off the wire.
+type h2Frame struct {
+	typ, flags byte
+	stream     uint32
+	payload    []byte
+}
+
+// h2cClient is the client end of a connection upgraded to HTTP/2.
+type h2cClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialH2C sends req, a request asking to switch to HTTP/2 with settings as
+// HTTP2-Settings, and reads the 101 response and the SETTINGS of the server.
+func dialH2C(t *testing.T, addr, req string, settings []byte) *h2cClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &h2cClient{t, conn, bufio.NewReader(conn)}
+	conn.Write([]byte(req + "Host: x\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " +
+		base64.RawURLEncoding.EncodeToString(settings) + "\r\n\r\n"))
+
+	var head strings.Builder
+	for {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read the 101 response: %v", err)
+		}
+		if head.WriteString(line); line == "\r\n" {
+			break
+		}
+	}
+	if want := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"; head.String() != want {
+		t.Fatalf("upgrade response = %q, want %q", head.String(), want)
+	}
+	if f := c.read(); f.typ != frameSettings || f.flags != 0 || f.stream != 0 || len(f.payload) != 0 {
+		t.Fatalf("server preface = %+v, want an empty SETTINGS frame", f)
+	}
+	return c
+}
+
+// preface sends the client connection preface with an empty SETTINGS frame
+// and reads its acknowledgment.
+func (c *h2cClient) preface() {
+	c.t.Helper()
+	c.conn.Write([]byte(h2Preface))
+	c.write(frameSettings, 0, 0, nil)
+	if f := c.read(); f.typ != frameSettings || f.flags != flagAck || len(f.payload) != 0 {
+		c.t.Fatalf("got %+v, want a SETTINGS acknowledgment", f)
+	}
+}
+
+func (c *h2cClient) write(typ, flags byte, stream uint32, payload []byte) {
+	n := len(payload)
+	hdr := []byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(hdr[5:], stream)
+	c.conn.Write(append(hdr, payload...))
+}
+
+func (c *h2cClient) windowUpdate(stream, increment uint32) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], increment)
+	c.write(frameWindowUpdate, 0, stream, payload[:])
+}
+
+func (c *h2cClient) read() h2Frame {
+	c.t.Helper()
+	var hdr [9]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		c.t.Fatalf("read a frame: %v", err)
+	}
+	f := h2Frame{typ: hdr[3], flags: hdr[4], stream: binary.BigEndian.Uint32(hdr[5:])}
+	f.payload = make([]byte, int(hdr[0])<<16|int(hdr[1])<<8|int(hdr[2]))
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		c.t.Fatalf("read a frame: %v", err)
+	}
+	return f
+}
+
+// blocked fails the test if a frame arrives within a moment.
+func (c *h2cClient) blocked() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.br.Peek(1); err == nil {
+		c.t.Fatalf("got a frame %+v, want none before a WINDOW_UPDATE", c.read())
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+}
+
+// goAway reads the GOAWAY ending the connection and returns its error code.
+func (c *h2cClient) goAway() uint32 {
+	c.t.Helper()
+	f := c.read()
+	if f.typ != frameGoAway || len(f.payload) != 8 {
+		c.t.Fatalf("got %+v, want a GOAWAY", f)
+	}
+	if last := binary.BigEndian.Uint32(f.payload); last != 1 {
+		c.t.Errorf("GOAWAY last stream = %d, want 1", last)
+	}
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		c.t.Errorf("read after the GOAWAY: %v, want the connection closed", err)
+	}
+	return binary.BigEndian.Uint32(f.payload[4:])
+}
+
+// headers reads a HEADERS frame of stream 1 and decodes its block as the
+// server encodes it, literals whose name is either new or :status.
+func (c *h2cClient) headers() (map[string]string, bool) {
+	c.t.Helper()
+	f := c.read()
+	if f.typ != frameHeaders || f.stream != 1 || f.flags&flagEndHeaders == 0 {
+		c.t.Fatalf("got %+v, want a complete HEADERS frame of stream 1", f)
+	}
+	fields := make(map[string]string)
+	for b := f.payload; len(b) > 0; {
+		var name, value string
+		var ok bool
+		switch b[0] {
+		case 0x00:
+			name, b, ok = hpackString(b[1:])
+		case 0x08:
+			name, b, ok = ":status", b[1:], true
+		}
+		if ok {
+			value, b, ok = hpackString(b)
+		}
+		if !ok {
+			c.t.Fatalf("undecodable header block %q", f.payload)
+		}
+		fields[name] = value
+	}
+	return fields, f.flags&flagEndStream != 0
+}
+
+// hpackString decodes a string literal shorter than 127 bytes.
+func hpackString(b []byte) (string, []byte, bool) {
+	if len(b) == 0 || b[0] >= 0x7f || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+// data reads DATA frames of stream 1 until n bytes are read.
+func (c *h2cClient) data(n int) (data []byte, endStream bool) {
+	c.t.Helper()
+	for len(data) < n {
+		f := c.read()
+		if f.typ != frameData || f.stream != 1 {
+			c.t.Fatalf("got %+v, want a DATA frame of stream 1", f)
+		}
+		if len(f.payload) > h2MaxFrameSize {
+			c.t.Errorf("DATA frame of %d bytes", len(f.payload))
+		}
+		data = append(data, f.payload...)
+		endStream = f.flags&flagEndStream != 0
+		if endStream && len(data) < n {
+			c.t.Fatalf("stream ended after %d bytes, want %d", len(data), n)
+		}
+	}
+	return data, endStream
+}
+
+// settingWindow is a SETTINGS payload setting the initial window size.
+func settingWindow(size uint32) []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b, settingInitialWindow)
+	binary.BigEndian.PutUint32(b[2:], size)
+	return b
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 7000))
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Proto != "HTTP/2.0" {
+			t.Errorf("request served as %s", req.Proto)
+		}
+		resp.WriteHeader("Content-Type", "text/plain")
+		switch req.Path {
+		case "/large":
+			resp.WriteData(body)
+		case "/":
+			resp.WriteString("hello, h2c")
+		}
+	}), nil)
+
+	t.Run("settings", func(t *testing.T) {
+		// the small initial window of HTTP2-Settings holds the body back
+		c := dialH2C(t, addr, "GET / HTTP/1.1\r\n", settingWindow(4))
+		c.preface()
+		fields, end := c.headers()
+		if fields[":status"] != "200" || fields["content-length"] != "10" || fields["content-type"] != "text/plain" || end {
+			t.Errorf("HEADERS = %q, end of stream %v", fields, end)
+		}
+		if _, ok := fields["connection"]; ok {
+			t.Errorf("connection-specific field sent: %q", fields)
+		}
+		if data, end := c.data(4); string(data) != "hell" || end {
+			t.Errorf("DATA %q, end of stream %v, want the 4 bytes of the window", data, end)
+		}
+		c.blocked()
+		c.windowUpdate(1, 100)
+		if data, end := c.data(6); string(data) != "o, h2c" || !end {
+			t.Errorf("DATA %q, end of stream %v, want the rest", data, end)
+		}
+		if code := c.goAway(); code != errCodeNo {
+			t.Errorf("GOAWAY error code = %d, want NO_ERROR", code)
+		}
+	})
+
+	t.Run("windows", func(t *testing.T) {
+		c := dialH2C(t, addr, "GET /large HTTP/1.1\r\n", nil)
+		c.preface()
+		if fields, _ := c.headers(); fields["content-length"] != "70000" {
+			t.Errorf("HEADERS = %q", fields)
+		}
+		sent, _ := c.data(h2InitialWindow)
+		c.blocked()
+		// frames of unknown types are ignored, the stream window alone
+		// doesn't let the response through
+		c.write(0xfa, 0, 0, []byte("ignored"))
+		c.windowUpdate(1, 10000)
+		c.blocked()
+		c.windowUpdate(0, 10000)
+		rest, end := c.data(len(body) - h2InitialWindow)
+		if !bytes.Equal(append(sent, rest...), body) || !end {
+			t.Errorf("got %d bytes, end of stream %v, want the body", len(sent)+len(rest), end)
+		}
+		if code := c.goAway(); code != errCodeNo {
+			t.Errorf("GOAWAY error code = %d, want NO_ERROR", code)
+		}
+	})
+
+	for _, method := range []string{"HEAD", "GET"} {
+		t.Run(method+" without a body", func(t *testing.T) {
+			path, length := "/", "10"
+			if method == "GET" {
+				path, length = "/empty", "0"
+			}
+			c := dialH2C(t, addr, method+" "+path+" HTTP/1.1\r\n", nil)
+			c.preface()
+			// the stream ends with the HEADERS, no DATA follows
+			if fields, end := c.headers(); fields[":status"] != "200" || fields["content-length"] != length || !end {
+				t.Errorf("HEADERS = %q, end of stream %v, want a content-length of %s and the end", fields, end, length)
+			}
+			if code := c.goAway(); code != errCodeNo {
+				t.Errorf("GOAWAY error code = %d, want NO_ERROR", code)
+			}
+		})
+	}
+}
+
+func TestH2CConnectionErrors(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		t.Errorf("request served after a connection error")
+	}), nil)
+
+	tests := []struct {
+		name    string
+		preface []byte
+		code    uint32
+	}{
+		{"bad preface", []byte("PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n"), errCodeProtocol},
+		{"unknown frame", append([]byte(h2Preface), 0, 0, 0, 0xfa, 0, 0, 0, 0, 0), errCodeProtocol},
+		{"oversized frame", append([]byte(h2Preface), 0, 0x40, 0x01, frameSettings, 0, 0, 0, 0, 0), errCodeFrameSize},
+		{"bad settings", append([]byte(h2Preface), 0, 0, 6, frameSettings, 0, 0, 0, 0, 0, 0, 4, 0x80, 0, 0, 0), errCodeFlowControl},
+	}
+	for _, tt := range tests {
+		c := dialH2C(t, addr, "GET / HTTP/1.1\r\n", nil)
+		c.conn.Write(tt.preface)
+		if code := c.goAway(); code != tt.code {
+			t.Errorf("%s: GOAWAY error code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestH2CNoUpgrade(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Proto)
+	}), nil)
+	const upgrade = "Host: x\r\nConnection: close, Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"
+
+	tests := []struct {
+		name, req string
+	}{
+		{"invalid settings", "GET / HTTP/1.1\r\n" + upgrade + "HTTP2-Settings: AAQ!\r\n\r\n"},
+		{"settings of a bad size", "GET / HTTP/1.1\r\n" + upgrade + "HTTP2-Settings: AAQ\r\n\r\n"},
+		{"no settings", "GET / HTTP/1.1\r\n" + upgrade + "\r\n"},
+		{"body", "POST / HTTP/1.1\r\n" + upgrade + "HTTP2-Settings: \r\nContent-Length: 2\r\n\r\nhi"},
+		{"HTTP/1.0", "GET / HTTP/1.0\r\n" + upgrade + "HTTP2-Settings: \r\n\r\n"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, tt.req)
+		if _, body := splitResponse(resp); !strings.HasPrefix(resp, "HTTP/1.1 200 ") || !strings.HasPrefix(body, "HTTP/1.") {
+			t.Errorf("%s: got %q, want the request served over HTTP/1", tt.name, resp)
+		}
+	}
+}
+
+func TestAppendHpackInt(t *testing.T) {
+	tests := []struct {
+		n     uint
+		first byte
+		v     uint64
+		want  []byte
+	}{
+		{5, 0x00, 30, []byte{0x1e}},
+		{5, 0x00, 31, []byte{0x1f, 0x00}},
+		{5, 0x00, 127, []byte{0x1f, 0x60}},
+		{5, 0x00, 128, []byte{0x1f, 0x61}},
+		{5, 0xe0, 1337, []byte{0xff, 0x9a, 0x0a}}, // RFC 7541 section C.1.2
+		{7, 0x00, 30, []byte{0x1e}},
+		{7, 0x00, 31, []byte{0x1f}},
+		{7, 0x00, 127, []byte{0x7f, 0x00}},
+		{7, 0x80, 128, []byte{0xff, 0x01}},
+		{8, 0x00, 42, []byte{0x2a}}, // RFC 7541 section C.1.3
+	}
+	for _, tt := range tests {
+		if got := appendHpackInt(nil, tt.n, tt.first, tt.v); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendHpackInt(%d, %#x, %d) = %#v, want %#v", tt.n, tt.first, tt.v, got, tt.want)
+		}
+	}
+}
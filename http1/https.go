@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectHTTPS serves the requests made over HTTPS with h, redirecting the
+// others to the https URL of the same host and request URI: with a 301 Moved
+// Permanently for GET and HEAD, a 308 Permanent Redirect for the other
+// methods to be kept.
+//
+// Behind a TLS terminator, trustForwardedProto takes the scheme the client
+// used from the X-Forwarded-Proto header the terminator sets, rather than
+// from the connection to the server. It is not to be set otherwise, the
+// header being up to the client to make up.
+func RedirectHTTPS(h Handler, trustForwardedProto bool) Handler {
+	return HandlerFunc(func(resp *Response, req *Request) {
+		https := req.TLS != nil
+		if trustForwardedProto {
+			// the first terminator the request went through is the one the
+			// client talked to
+			proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+			https = strings.EqualFold(strings.TrimSpace(proto), "https")
+		}
+		if https {
+			h.ServeHTTP(resp, req)
+			return
+		}
+
+		if req.Host == "" {
+			Error(resp, "400 bad request: missing host", http.StatusBadRequest)
+			return
+		}
+		host := req.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname // the port of plain HTTP isn't the one of HTTPS
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+		uri := req.RequestURI
+		if isAbsoluteURI(uri) {
+			u, err := url.Parse(uri)
+			if err != nil {
+				Error(resp, "400 bad request", http.StatusBadRequest)
+				return
+			}
+			uri = u.RequestURI()
+		}
+
+		code := http.StatusPermanentRedirect
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		resp.Redirect(code, "https://"+host+uri)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	ok := HandlerFunc(func(resp *Response, req *Request) { resp.WriteString("ok") })
+	tests := []struct {
+		name           string
+		trust          bool
+		method, host   string
+		uri, forwarded string
+		tls            bool
+		code           int
+		location       string
+	}{
+		{"plain HTTP", false, "GET", "example.com", "/a?b=c", "", false, 301, "https://example.com/a?b=c"},
+		{"port dropped", false, "GET", "example.com:8080", "/", "", false, 301, "https://example.com/"},
+		{"IPv6 host", false, "GET", "[::1]:8080", "/", "", false, 301, "https://[::1]/"},
+		{"method kept", false, "POST", "example.com", "/form", "", false, 308, "https://example.com/form"},
+		{"absolute URI", false, "GET", "example.com", "http://example.com/p?q", "", false, 301, "https://example.com/p?q"},
+		{"over TLS", false, "GET", "example.com", "/", "", true, 200, ""},
+		{"forwarded header not trusted", false, "GET", "example.com", "/", "https", false, 301, "https://example.com/"},
+		{"forwarded http", true, "GET", "example.com", "/a", "http", true, 301, "https://example.com/a"},
+		{"forwarded https", true, "GET", "example.com", "/a", "HTTPS, http", false, 200, ""},
+		{"missing host", false, "GET", "", "/", "", false, 400, ""},
+	}
+	for _, tt := range tests {
+		req := &Request{Method: tt.method, Host: tt.host, RequestURI: tt.uri, Header: make(http.Header)}
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.forwarded)
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		resp := &Response{req: req}
+		RedirectHTTPS(ok, tt.trust).ServeHTTP(resp, req)
+		code := resp.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		if code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.code)
+		}
+		if got := resp.header.Get("Location"); got != tt.location {
+			t.Errorf("%s: Location = %q, want %q", tt.name, got, tt.location)
+		}
+		if tt.code == http.StatusOK && string(resp.data) != "ok" {
+			t.Errorf("%s: not passed through, body %q", tt.name, resp.data)
+		}
+	}
+}
@@ -2,140 +2,565 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/textproto"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func must(msg string, err error) {
-	if err != nil {
-		panic("failed to " + msg + ": " + err.Error())
-	}
-}
+// ErrBodyTooLarge is returned reading a request body past the MaxBodyBytes of
+// the server.
+var ErrBodyTooLarge = errors.New("request body too large")
 
-func errorLog(msg string, err error) {
-	log.Printf("[ERROR] failed to %s: %v", msg, err)
+// ErrBodyReadAfterClose is returned reading a request body once closed.
+var ErrBodyReadAfterClose = errors.New("read on closed request body")
+
+func (srv *Server) errorLog(msg string, err error) {
+	srv.logger().Printf("[ERROR] failed to %s: %v", msg, err)
 }
 
-func infoLog(msg string) {
-	log.Printf("[INFO] %s", msg)
+func (srv *Server) infoLog(msg string) {
+	srv.logger().Printf("[INFO] %s", msg)
 }
 
 func main() {
-	l, err := net.Listen("tcp", ":3000")
-	must("listen on :3000", err)
+	addr := flag.String("addr", ":3000", `address to listen on, "unix:" followed by a path for a Unix socket`)
+	static := flag.String("static", "static", "directory served under /static/")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve HTTPS with, along with -tls-key")
+	tlsKey := flag.String("tls-key", "", "private key file of -tls-cert")
+	withMetrics := flag.Bool("metrics", false, "serve the server metrics under /metrics")
+	maxRequests := flag.Int("max-requests-per-conn", 0, "requests served on a connection before closing it, 0 for no limit")
+	trace := flag.Bool("trace", false, "answer TRACE requests with the request received")
+	proxy := flag.Bool("proxy", false, "tunnel CONNECT requests to the host they name")
+	flag.Parse()
 
-	infoLog("starting server, listen on :3000")
-	for {
-		infoLog("start listening...")
-		conn, err := l.Accept()
+	mux := NewServeMux()
+	srv := NewServer(*addr, mux)
+	srv.MaxRequestsPerConn = *maxRequests
+	srv.Trace = *trace
+	srv.Proxy = *proxy
+	mux.HandleFunc("/", handlerFn)
+	mux.Handle("/static/", StripPrefix("/static", FileServer(*static)))
+	if *withMetrics {
+		mux.HandleMethod(http.MethodGet, "/metrics", srv.Metrics())
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
 		if err != nil {
-			errorLog("accept connection", err)
-			continue
+			log.Fatalf("load TLS key pair: %v", err)
 		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
-		go handleConn(conn)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.infoLog("shutting down")
+		if err := srv.Shutdown(); err != nil {
+			srv.errorLog("close listener", err)
+		}
+	}()
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("serve: %v", err)
 	}
 }
 
-func handleConn(conn net.Conn) {
-	defer conn.Close()
-	infoLog("start processing connection")
+// readRequest reads the next request from r, idle telling whether it is
+// awaited on a kept-alive connection. io.EOF is returned as is when the client
+// closed the connection before sending another request, or didn't send it
+// within IdleTimeout. Interim responses to the request are written to w.
+func (srv *Server) readRequest(conn net.Conn, r *bufio.Reader, w *bufio.Writer, idle bool) (*Request, error) {
+	if idle {
+		timeout := srv.IdleTimeout
+		if timeout == 0 {
+			timeout = srv.ReadTimeout
+		}
+		if err := conn.SetReadDeadline(deadline(timeout)); err != nil {
+			return nil, err
+		}
+		if !srv.setIdle(conn, true) {
+			return nil, io.EOF // shutting down
+		}
+		_, err := r.Peek(1)
+		srv.setIdle(conn, false)
+		if err != nil {
+			if isTimeout(err) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+	}
+	// set even without a timeout, in case Shutdown set one as the request
+	// was coming
+	if err := conn.SetReadDeadline(deadline(srv.ReadTimeout)); err != nil {
+		return nil, err
+	}
 
-	r := bufio.NewReader(conn)
-	method, requestURI, proto, err := parseRequestLine(r)
+	// the request line and the header lines share a single budget
+	hr := srv.newHeadReader(r)
+	method, requestURI, proto, err := srv.parseRequestLine(hr)
 	if err != nil {
-		errorLog("parse request line", err)
-		return
+		if isTimeout(err) {
+			return nil, statusError{http.StatusRequestTimeout, err}
+		}
+		return nil, err
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, statusError{http.StatusBadRequest, fmt.Errorf("malformed HTTP version: %q", proto)}
+	}
+	if major != 1 {
+		// HTTP/2 and later aren't served over this plaintext text protocol
+		return nil, statusError{http.StatusHTTPVersionNotSupported, fmt.Errorf("unsupported HTTP version: %s", proto)}
+	}
+	if minor > 1 {
+		// a later minor version is compatible with 1.1 (RFC 7230 section 2.6)
+		proto, minor = "HTTP/1.1", 1
 	}
 
-	header, err := parseMIMEHeader(r)
+	header, err := parseMIMEHeader(hr)
+	if err == io.EOF && minor == 0 {
+		// some HTTP/1.0 clients close their side right after the last
+		// header line, or the request line, the request is complete all the
+		// same
+		err = nil
+	}
 	if err != nil {
-		errorLog("parse MIME header", err)
-		return
+		if isTimeout(err) {
+			return nil, statusError{http.StatusRequestTimeout, err}
+		}
+		return nil, fmt.Errorf("parse MIME header: %w", err)
 	}
-	contentLength, err := parseContentLength(header)
+
+	// the body is read at the pace of the handler
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if len(header["Transfer-Encoding"]) > 0 && len(header["Content-Length"]) > 0 {
+		// a message framed twice is a request smuggling attempt
+		return nil, statusError{http.StatusBadRequest, errors.New("both Transfer-Encoding and Content-Length are present")}
+	}
+	switch hosts := len(header["Host"]); {
+	case hosts > 1:
+		return nil, statusError{http.StatusBadRequest, errors.New("multiple Host headers")}
+	case hosts == 0 && minor == 1:
+		return nil, statusError{http.StatusBadRequest, errors.New("missing Host header")}
+	}
+	host := header.Get("Host")
+	if method == http.MethodConnect {
+		// authority-form, the host and port to open a tunnel to
+		if _, _, err := net.SplitHostPort(requestURI); err != nil {
+			return nil, statusError{http.StatusBadRequest, fmt.Errorf("invalid CONNECT authority: %q", requestURI)}
+		}
+		host = requestURI
+	} else if isAbsoluteURI(requestURI) {
+		// absolute-form sent to proxies, the host it names prevails over
+		// the Host header
+		u, err := url.Parse(requestURI)
+		if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return nil, statusError{http.StatusBadRequest, fmt.Errorf("invalid request URI: %q", requestURI)}
+		}
+		host, requestURI = u.Host, u.RequestURI()
+	}
+	var path string
+	if method != http.MethodConnect {
+		rawPath, _, _ := strings.Cut(requestURI, "?")
+		path, err = url.PathUnescape(rawPath)
+		if err != nil || strings.IndexByte(path, 0) >= 0 {
+			return nil, statusError{http.StatusBadRequest, fmt.Errorf("invalid request URI: %q", requestURI)}
+		}
+		switch {
+		case strings.HasPrefix(path, "/"):
+			// handlers see the canonical path, never above the root
+			var ok bool
+			if path, ok = cleanPath(path); !ok {
+				return nil, statusError{http.StatusBadRequest, fmt.Errorf("request path above the root: %q", requestURI)}
+			}
+		case path == "*" && method == http.MethodOptions:
+		default:
+			return nil, statusError{http.StatusBadRequest, fmt.Errorf("invalid request URI: %q", requestURI)}
+		}
+	}
+
+	// 100-continue is the only expectation defined, others get a 417 unless
+	// from HTTP/1.0 clients, ignored (RFC 7231 section 5.1.1). A client
+	// waiting for a 100 Continue with a body announced too large gets the
+	// 413 instead, never sending it.
+	expect := header.Get("Expect")
+	if minor == 1 && expect != "" && !strings.EqualFold(expect, "100-continue") {
+		return nil, statusError{http.StatusExpectationFailed, fmt.Errorf("unsupported expectation: %q", expect)}
+	}
+	body, err := srv.makeBodyReadCloser(r, header)
 	if err != nil {
-		errorLog("parse Content-Length", err)
-		return
+		return nil, err
+	}
+	if minor == 1 && !body.empty() && expect != "" {
+		body.expect = w
+	}
+
+	var tlsState *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		tlsState = &state
 	}
 
 	// construct Request object
-	req := Request{
-		RemoteAddr: conn.RemoteAddr().String(),
+	return &Request{
+		RemoteAddr: remoteAddr(conn),
 		Method:     method,
+		Host:       host,
 		RequestURI: requestURI,
+		Path:       path,
 		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
 		Header:     header,
-		Body: struct {
-			io.Reader
-			io.Closer
-		}{io.LimitReader(r, contentLength), ioutil.NopCloser(r)},
+		Body:       body,
+		TLS:        tlsState,
+		srv:        srv,
+		body:       body,
+	}, nil
+}
+
+// deadline returns the time timeout from now, the zero time for no timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(timeout)
+}
 
-	resp := Response{}
-	handlerFn(&req, &resp)
+// isAbsoluteURI reports whether uri is in the absolute-form such as
+// "http://example.com/path", rather than a path or an authority.
+func isAbsoluteURI(uri string) bool {
+	return !strings.HasPrefix(uri, "/") && strings.Contains(uri, "://")
+}
 
-	if _, err := conn.Write(resp.respond()); err != nil {
-		errorLog("write response", err)
+// remoteAddr returns the address of the peer of conn, empty when it has none
+// as the clients of Unix sockets usually.
+func remoteAddr(conn net.Conn) string {
+	switch a := conn.RemoteAddr().(type) {
+	case nil:
+		return ""
+	case *net.UnixAddr:
+		// an unbound socket, named "@" on Linux
+		if a == nil || a.Name == "@" {
+			return ""
+		}
 	}
-	infoLog("end of connection")
+	return conn.RemoteAddr().String()
 }
 
-func parseRequestLine(r *bufio.Reader) (method, requestURI, proto string, err error) {
-	// First line: GET /index.html HTTP/1.0
-	line, err := r.ReadString('\n')
+// cleanPath returns the canonical form of the rooted path p, its "." and ".."
+// segments resolved and its trailing slash kept. It reports false when a ".."
+// would climb above the root, as in "/a/../../etc/passwd".
+func cleanPath(p string) (string, bool) {
+	depth := 0
+	for _, seg := range strings.Split(p[1:], "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return "", false
+			}
+		default:
+			depth++
+		}
+	}
+	cp := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cp != "/" {
+		cp += "/"
+	}
+	return cp, true
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// statusError is an error in reading a request that is answered with code
+// before the connection is closed. Other errors reading a request leave the
+// connection unusable, it is closed without a response.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e statusError) Error() string { return e.err.Error() }
+
+func (e statusError) Unwrap() error { return e.err }
+
+// shouldKeepAlive reports whether the connection can be reused after
+// responding to req. HTTP/1.1 connections are persistent unless the client
+// asks to close, HTTP/1.0 ones only when the client asks to keep them alive.
+// Asking for both closes the connection.
+func shouldKeepAlive(req *Request) bool {
+	if req.hasConnectionToken("close") {
+		return false
+	}
+	return req.ProtoAtLeast(1, 1) || req.hasConnectionToken("keep-alive")
+}
+
+// headerTokens returns the comma separated tokens of the name header lines in
+// lowercase, as "keep-alive, Upgrade" gives "keep-alive" and "upgrade". Empty
+// list elements are skipped (RFC 7230 section 7).
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, strings.ToLower(t))
+			}
+		}
+	}
+	return tokens
+}
+
+// headerHasToken reports whether token is among the tokens of the name header
+// lines, compared case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConnectionToken reports whether the Connection header of req lists the
+// connection option tok, such as "close" or "upgrade".
+func (req *Request) hasConnectionToken(tok string) bool {
+	return headerHasToken(req.Header, "Connection", tok)
+}
+
+// headReader reads the lines of a request head, the request line then the
+// header lines, out of one budget of bytes for them all. Reading a trailer
+// section, it is given a budget of its own.
+type headReader struct {
+	r          *bufio.Reader
+	budget     int // bytes left for the lines of the head
+	strictCRLF bool
+}
+
+// newHeadReader returns a reader of the head read from r, bounded by
+// MaxHeaderBytes.
+func (srv *Server) newHeadReader(r *bufio.Reader) *headReader {
+	return &headReader{r: r, budget: lineLimit(srv.MaxHeaderBytes), strictCRLF: srv.StrictCRLF}
+}
+
+var errHeadTooLarge = errors.New("request head too large")
+
+// readLine reads the next line of the head without its terminator, giving up
+// with errTooLong for a line longer than max bytes, or with errHeadTooLarge
+// once the line goes past the budget of the head, a line past both being
+// too long. io.EOF is kept for the end of the input between lines, and a bare
+// LF is rejected if strictCRLF.
+func (hr *headReader) readLine(max int) (string, error) {
+	// a line of bounded length is read up to its bound whatever the budget
+	// left, for a line too long to be told from a head too large
+	limit := max
+	if max == math.MaxInt {
+		limit = hr.budget
+	}
+	line, err := readStringLimit(hr.r, limit)
+	if err == errTooLong && max == math.MaxInt {
+		return "", errHeadTooLarge
+	}
 	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if len(line) > hr.budget {
+		return "", errHeadTooLarge
+	}
+	hr.budget -= len(line)
+	line, crlf := trimEOL(line)
+	if hr.strictCRLF && !crlf {
+		return "", statusError{http.StatusBadRequest, fmt.Errorf("line not ended by CRLF: %q", line)}
+	}
+	return line, nil
+}
+
+func (srv *Server) parseRequestLine(hr *headReader) (method, requestURI, proto string, err error) {
+	// First line: GET /index.html HTTP/1.0
+	line, err := hr.readLine(lineLimit(srv.MaxRequestLineBytes))
+	switch err {
+	case nil:
+	case errTooLong:
+		return "", "", "", statusError{http.StatusRequestURITooLong, errors.New("request line too long")}
+	case errHeadTooLarge:
+		return "", "", "", statusError{http.StatusRequestHeaderFieldsTooLarge, err}
+	default:
 		return "", "", "", err
 	}
 
 	method, rest, ok1 := strings.Cut(line, " ")
 	requestURI, proto, ok2 := strings.Cut(rest, " ")
 	if !ok1 || !ok2 {
-		return "", "", "", errors.New("invalid request line")
+		return "", "", "", statusError{http.StatusBadRequest, fmt.Errorf("invalid request line: %q", line)}
 	}
 	return method, requestURI, proto, nil
 }
 
-func parseMIMEHeader(r *bufio.Reader) (header http.Header, err error) {
+// ows is the optional whitespace around header values, a CR or any other
+// control character left in them being invalid (RFC 7230 section 3.2.3).
+const ows = " \t"
+
+// parseMIMEHeader reads the header lines up to the empty line ending them,
+// out of what is left of the budget of hr.
+func parseMIMEHeader(hr *headReader) (header http.Header, err error) {
 	header = make(http.Header)
 
+	lastKey := ""
 	for {
-		kv, err := r.ReadString('\n')
+		kv, err := hr.readLine(math.MaxInt)
+		if err == errHeadTooLarge {
+			return header, statusError{http.StatusRequestHeaderFieldsTooLarge, err}
+		}
 		if err != nil {
 			return header, err
 		}
+		if kv == "" {
+			return header, nil
+		}
 
-		kv = strings.TrimSpace(kv)
-		if len(kv) == 0 {
-			return header, err
+		if kv[0] == ' ' || kv[0] == '\t' {
+			// obsolete line folding, the line continues the previous value
+			if lastKey == "" {
+				return header, statusError{http.StatusBadRequest, fmt.Errorf("invalid header continuation: %q", kv)}
+			}
+			values := header[lastKey]
+			if v := strings.Trim(kv, ows); !isFieldValue(v) {
+				return header, statusError{http.StatusBadRequest, fmt.Errorf("invalid header value of %s: %q", lastKey, v)}
+			} else if v != "" {
+				values[len(values)-1] += " " + v
+			}
+			continue
 		}
 
 		k, v, ok := strings.Cut(kv, ":")
 		if !ok {
-			return header, fmt.Errorf("invalid header: %s", kv)
+			return header, statusError{http.StatusBadRequest, fmt.Errorf("invalid header: %s", kv)}
+		}
+		// no whitespace is allowed between the field name and the colon
+		// (RFC 7230 section 3.2.4)
+		if !isToken(k) {
+			return header, statusError{http.StatusBadRequest, fmt.Errorf("invalid header name: %q", k)}
+		}
+		k, v = textproto.CanonicalMIMEHeaderKey(k), strings.Trim(v, ows)
+		if !isFieldValue(v) {
+			return header, statusError{http.StatusBadRequest, fmt.Errorf("invalid header value of %s: %q", k, v)}
 		}
-		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
 		header[k] = append(header[k], v)
+		lastKey = k
+	}
+}
+
+// trimEOL removes the line terminator of line, reporting whether it is CRLF
+// rather than a bare LF.
+func trimEOL(line string) (string, bool) {
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasSuffix(line, "\r") {
+		return line[:len(line)-1], true
+	}
+	return line, false
+}
+
+// isToken reports whether s is a non-empty token (RFC 7230 section 3.2.6).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b <= ' ' || b >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, b) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValue reports whether s is made of visible characters, spaces and
+// tabs only, as allowed in a header value (RFC 7230 section 3.2), rejecting
+// control characters such as a bare CR or NUL.
+func isFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if b := s[i]; b < ' ' && b != '\t' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+var errTooLong = errors.New("line too long")
+
+// lineLimit returns the limit configured, or no limit at all when zero, for
+// readStringLimit.
+func lineLimit(max int) int {
+	if max <= 0 {
+		return math.MaxInt
+	}
+	return max
+}
+
+// readStringLimit is like r.ReadString('\n') but gives up with errTooLong as
+// soon as the line is found to be longer than max bytes. Every line before
+// the body, through headReader, the ends of chunks and the trailers are read
+// with it, bounding the memory a client can take up; trimEOL then removes
+// their terminator.
+func readStringLimit(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > max {
+			return "", errTooLong
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
 	}
 }
 
 func parseContentLength(h http.Header) (int64, error) {
-	cl := h.Get("Content-Length")
-	if len(cl) == 0 {
-		if len(h["content-length"]) > 0 {
-			cl = h["content-length"][0]
+	// repeated values are only accepted when they all agree
+	cl := ""
+	for _, v := range h["Content-Length"] {
+		for _, vv := range strings.Split(v, ",") {
+			vv = textproto.TrimString(vv)
+			if cl != "" && vv != cl {
+				return 0, fmt.Errorf("conflicting Content-Length: %s, %s", cl, vv)
+			}
+			cl = vv
 		}
 	}
 
-	cl = textproto.TrimString(cl)
 	if cl == "" {
 		return -1, nil
 	}
@@ -146,37 +571,251 @@ func parseContentLength(h http.Header) (int64, error) {
 	return int64(n), nil
 }
 
-func handlerFn(req *Request, resp *Response) {
-	fmt.Println(req.RemoteAddr)
-	fmt.Println(req.Method)
-	fmt.Println(req.RequestURI)
-	fmt.Println(req.Header)
+// makeBodyReadCloser returns the body following header in r, framed either by
+// the chunked transfer coding or by Content-Length. Without either, the
+// request has no body whatever its method (RFC 7230 section 3.3.3). The
+// transfer codings applied before chunked are decoded as well.
+func (srv *Server) makeBodyReadCloser(r *bufio.Reader, header http.Header) (*body, error) {
+	codings, err := transferCodings(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(codings) > 0 {
+		var decoded io.Reader = newChunkedReader(r, srv)
+		for i := len(codings) - 2; i >= 0; i-- {
+			decoded = &transferDecoder{src: decoded, newDec: transferDecoders[codings[i]]}
+		}
+		return newBody(decoded, srv.MaxBodyBytes), nil
+	}
 
-	body, err := ioutil.ReadAll(req.Body)
+	contentLength, err := parseContentLength(header)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Println(string(body))
+		return nil, statusError{http.StatusBadRequest, fmt.Errorf("parse Content-Length: %w", err)}
+	}
+	if contentLength <= 0 {
+		return &body{r: http.NoBody, n: -1}, nil
+	}
+	if srv.MaxBodyBytes > 0 && contentLength > srv.MaxBodyBytes {
+		return nil, statusError{http.StatusRequestEntityTooLarge, ErrBodyTooLarge}
 	}
+	return newBody(io.LimitReader(r, contentLength), srv.MaxBodyBytes), nil
+}
+
+// lingerTimeout bounds the time to wait for a client to close a connection
+// closed on the server side.
+const lingerTimeout = 500 * time.Millisecond
+
+// maxDrainBytes bounds the unread body discarded to reuse a connection.
+const maxDrainBytes = 256 << 10
+
+// body is the body of a request. Closing it discards whatever is left unread
+// so that the next request on the connection can be read.
+//
+// r never reads past the body, bounded by its Content-Length or chunked
+// framing, so neither does discarding it: whatever follows in the connection
+// buffer is the next pipelined request.
+type body struct {
+	r        io.Reader
+	n        int64 // bytes left before exceeding the limit, negative for no limit
+	tooLarge bool
+	closed   bool
+	eof      bool // r was read to its end
+
+	// expect is the client waiting for a 100 Continue before sending the
+	// body, it is sent on the first read unless the final response is first
+	expect *bufio.Writer
 
+	// forms are the multipart forms parsed from the body, by the request or
+	// the copies middleware make of it, their files removed once served
+	forms []*multipart.Form
+}
+
+// newBody returns the body read from r, up to max bytes unless max is zero.
+func newBody(r io.Reader, max int64) *body {
+	if max <= 0 {
+		return &body{r: r, n: -1}
+	}
+	return &body{r: r, n: max}
+}
+
+// empty reports whether the request has no body, reading it ends right away.
+func (b *body) empty() bool { return b.r == http.NoBody }
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.expect != nil {
+		w := b.expect
+		b.expect = nil
+		if _, err := w.WriteString("HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return 0, err
+		}
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	if b.tooLarge {
+		return 0, ErrBodyTooLarge
+	}
+	if b.n < 0 {
+		return b.read(p)
+	}
+
+	// read a byte more than allowed to tell whether the body goes past the limit
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.read(p)
+	if int64(n) > b.n {
+		n, b.n, b.tooLarge = int(b.n), 0, true
+		return n, ErrBodyTooLarge
+	}
+	b.n -= int64(n)
+	return n, err
+}
+
+func (b *body) read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// errBodyLeft is returned discarding a body with more than maxDrainBytes left.
+var errBodyLeft = errors.New("request body left unread")
+
+// Close discards the rest of the body, up to maxDrainBytes, without asking
+// for it a client waiting for a 100 Continue. Either way the connection is
+// closed after the response rather than read past what is left.
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+	err := b.drain()
+	b.closed = true
+	if err == errBodyLeft {
+		return nil
+	}
+	return err
+}
+
+// drain discards up to maxDrainBytes left unread, returning nil if that is
+// the end of the body, errBodyLeft if there is more. What is discarded isn't
+// held against MaxBodyBytes, it is never served.
+func (b *body) drain() error {
+	switch {
+	case b.eof:
+		return nil
+	case b.closed, b.tooLarge, b.expect != nil:
+		return errBodyLeft
+	}
+	_, err := io.CopyN(ioutil.Discard, b.r, maxDrainBytes+1)
+	switch err {
+	case io.EOF:
+		b.eof = true
+		return nil
+	case nil:
+		return errBodyLeft
+	}
+	return err
+}
+
+func handlerFn(resp *Response, req *Request) {
 	resp.WriteStatus(http.StatusOK)
 	resp.WriteHeader("Content-Type", "text/plain")
 	resp.WriteData([]byte("hello world"))
 }
 
 type Request struct {
-	RemoteAddr string
+	RemoteAddr string // empty for requests over a Unix socket
 	Method     string
-	RequestURI string
-	Proto      string
+	Host       string // from the request URI in absolute-form, or the Host header
+	RequestURI string // as sent, percent-encoded
+	Path       string // path of RequestURI, percent-decoded, empty for CONNECT
+	Proto      string // "HTTP/1.0", "HTTP/1.1", or "HTTP/2.0" once upgraded to h2c
+	ProtoMajor int
+	ProtoMinor int
 	Header     http.Header
 	Body       io.ReadCloser
+	Form       url.Values // parsed by ParseForm
+
+	// TLS is the state of the connection the request came from, nil for
+	// requests sent in plaintext.
+	TLS *tls.ConnectionState
+
+	// MultipartForm is parsed by ParseMultipartForm.
+	MultipartForm *multipart.Form
+
+	ctx   context.Context
+	srv   *Server
+	body  *body // Body as read from the connection
+	query url.Values
+}
+
+// Context returns the context of the request, canceled once the connection
+// it came from is done with. For a request without a body, the connection is
+// watched while the handler runs, the context being canceled as soon as the
+// client closes it: the handler can give up on a response nobody waits for.
+// For the others, only the reads of the body tell the client is gone.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// ProtoAtLeast reports whether the HTTP version of the request is at least
+// major.minor.
+func (req *Request) ProtoAtLeast(major, minor int) bool {
+	return req.ProtoMajor > major || req.ProtoMajor == major && req.ProtoMinor >= minor
+}
+
+// Query returns the decoded query parameters of the request URI. Malformed
+// pairs are dropped.
+func (req *Request) Query() url.Values {
+	if req.query == nil {
+		_, rawQuery, _ := strings.Cut(req.RequestURI, "?")
+		req.query, _ = url.ParseQuery(rawQuery)
+	}
+	return req.query
+}
+
+// ReadBody reads the whole body, failing with ErrBodyTooLarge rather than
+// reading more than max bytes of it. A body announced longer than max by its
+// Content-Length isn't read at all.
+func (req *Request) ReadBody(max int64) ([]byte, error) {
+	if cl, err := parseContentLength(req.Header); err == nil && cl > max {
+		return nil, ErrBodyTooLarge
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return b, err
+	}
+	if int64(len(b)) > max {
+		return b[:max], ErrBodyTooLarge
+	}
+	return b, nil
 }
 
 type Response struct {
 	status int
 	header http.Header
 	data   []byte
+
+	w       *bufio.Writer // the connection
+	req     *Request
+	srv     *Server
+	trailer http.Header
+	chunked bool // the head is sent and data is being streamed in chunks
+	sent    bool // the head and the whole body are sent, by writeContent
+	size    int  // bytes of body sent
+
+	conn     net.Conn          // nil when the connection can't be hijacked
+	rw       *bufio.ReadWriter // buffering conn
+	cr       *connReader       // reading conn for rw, nil along with conn
+	hijacked bool
 }
 
 func (r *Response) WriteStatus(code int) {
@@ -188,26 +827,470 @@ func (r *Response) WriteStatus(code int) {
 
 func (r *Response) WriteData(data []byte) { r.data = append(r.data, data...) }
 
+func (r *Response) WriteString(s string) { r.data = append(r.data, s...) }
+
+// Write makes the response an io.Writer, for encoders and templates to write
+// the body to. It adds p to the buffered body, or sends it as a chunk once
+// the body is streamed, failing with ErrHijacked once the connection is
+// hijacked.
+func (r *Response) Write(p []byte) (int, error) {
+	if r.headSent() || r.hijacked {
+		if err := r.WriteChunk(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	r.WriteData(p)
+	return len(p), nil
+}
+
+func (r *Response) Writef(format string, args ...any) {
+	r.data = append(r.data, fmt.Sprintf(format, args...)...)
+}
+
+// WriteJSON writes v encoded in JSON as the body. Nothing is written when v
+// can't be encoded.
+func (r *Response) WriteJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.WriteHeader("Content-Type", "application/json; charset=utf-8")
+	r.WriteData(b)
+	return nil
+}
+
+// Redirect replies with a code redirection to location, along with a short
+// HTML body linking to it for clients not following redirects.
+func (r *Response) Redirect(code int, location string) {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		panic(fmt.Sprintf("invalid redirect code %v", code))
+	}
+
+	r.WriteStatus(code)
+	r.WriteHeader("Location", location)
+	r.WriteHeader("Content-Type", "text/html; charset=utf-8")
+	r.WriteData([]byte("<a href=\"" + html.EscapeString(location) + "\">" + reasonPhrase(code) + "</a>.\n"))
+}
+
+// WriteChunk sends data to the client right away as a chunk of a body with
+// the chunked transfer coding. The status line and headers are sent on the
+// first call, so they can't be changed afterwards. HTTP/1.0 clients don't
+// understand chunks, HTTP/2 has no chunks, HEAD responses and those of a
+// status such as 204 have no body, and the response of a TimeoutHandler is
+// sent as a whole: data is then buffered as with WriteData.
+func (r *Response) WriteChunk(data []byte) error {
+	if r.hijacked {
+		return ErrHijacked
+	}
+	if r.sent {
+		return errSent
+	}
+	r.defaultStatus()
+	if r.w == nil || r.req == nil || r.req.Proto != "HTTP/1.1" || r.req.Method == http.MethodHead || !bodyAllowed(r.status) {
+		r.WriteData(data)
+		return nil
+	}
+	if !r.chunked {
+		r.chunked = true
+		// the chunks frame the body, a length would frame it twice
+		delete(r.header, "Content-Length")
+		r.WriteHeader("Transfer-Encoding", "chunked")
+		r.declareTrailers()
+		if err := r.writeHead(); err != nil {
+			return err
+		}
+		// data buffered before streaming started goes out first
+		data, r.data = append(r.data, data...), nil
+	}
+	if len(data) == 0 {
+		return r.w.Flush() // an empty chunk would terminate the body
+	}
+	if _, err := fmt.Fprintf(r.w, "%x\r\n%s\r\n", len(data), data); err != nil {
+		return err
+	}
+	r.size += len(data)
+	return r.w.Flush()
+}
+
+// errSent is returned writing to a response once sent.
+var errSent = errors.New("final response already sent")
+
+// headSent reports whether the status line and header are sent already, the
+// body being streamed in chunks or sent along by writeContent.
+func (r *Response) headSent() bool { return r.chunked || r.sent }
+
+// writeContent sends the head with length bytes of content as the body, read
+// right away rather than buffered, for bodies too large to be held in
+// memory. The response is sent then, nothing more can be written to it.
+// Content isn't read at all for HEAD requests. Without an HTTP/1.x
+// connection to write to, the content is buffered as with WriteData.
+//
+// The connection is closed after the response if copying content fails,
+// the body falling short of its Content-Length.
+func (r *Response) writeContent(content io.Reader, length int64) error {
+	r.defaultStatus()
+	delete(r.header, "Content-Length")
+	r.WriteHeader("Content-Length", strconv.FormatInt(length, 10))
+	isHead := r.req != nil && r.req.Method == http.MethodHead
+	if r.w == nil || r.req == nil || r.req.ProtoMajor != 1 {
+		if isHead {
+			return nil // the Content-Length is kept for HEAD
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(content, data); err != nil {
+			return err
+		}
+		r.data = data
+		return nil
+	}
+
+	r.sent, r.data = true, nil
+	if err := r.writeHead(); err != nil {
+		return err
+	}
+	if isHead {
+		return nil
+	}
+	n, err := io.CopyN(r.w, content, length)
+	r.size = int(n)
+	if err != nil {
+		r.header["Connection"] = []string{"close"}
+		return err
+	}
+	return nil
+}
+
+// declareTrailers lists the trailer fields set so far in the Trailer header,
+// along with those the handler declared itself.
+func (r *Response) declareTrailers() {
+	var fields []string
+	for k := range r.trailer {
+		if !headerHasToken(r.header, "Trailer", k) {
+			fields = append(fields, k)
+		}
+	}
+	if len(fields) > 0 {
+		sort.Strings(fields)
+		r.WriteHeader("Trailer", strings.Join(fields, ", "))
+	}
+}
+
+// WriteInformational sends an interim response of code, a 1xx status other
+// than 101 Switching Protocols, with header right away, such as a 103 Early
+// Hints with the Link headers of resources to preload. It can be called more
+// than once before the final response is sent. HTTP/1.0 clients don't
+// understand interim responses (RFC 7231 section 6.2), nor are they sent over
+// HTTP/2 here: nothing is sent then.
+func (r *Response) WriteInformational(code int, header http.Header) error {
+	if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+		panic(fmt.Sprintf("invalid WriteInformational code %v", code))
+	}
+	for k, v := range header {
+		for _, vv := range v {
+			checkHeaderField(k, vv)
+		}
+	}
+	if r.hijacked {
+		return ErrHijacked
+	}
+	if r.headSent() {
+		return errSent
+	}
+	if r.w == nil || r.req == nil || r.req.Proto != "HTTP/1.1" {
+		return nil
+	}
+	if code == http.StatusContinue && r.req.body != nil {
+		r.req.body.expect = nil // sent now rather than on the first read
+	}
+
+	r.w.WriteString("HTTP/1.1 " + strconv.Itoa(code) + " " + reasonPhrase(code) + "\r\n")
+	writeHeaderLines(r.w, header, r.srv.SortHeaders)
+	if _, err := r.w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// SetTrailer sets a trailer field sent after the body, declared beforehand in
+// the Trailer header for clients to expect it. Trailers need the chunked
+// transfer coding, the body is sent in chunks for them, and they are
+// dropped for HTTP/1.0 clients.
+//
+// The trailers set before the body is streamed are declared along with the
+// head. Once it is sent, SetTrailer panics for a field the handler didn't
+// declare itself with WriteHeader("Trailer", field) beforehand.
+func (r *Response) SetTrailer(field, value string) {
+	checkHeaderField(field, value)
+	if r.chunked && !headerHasToken(r.header, "Trailer", field) {
+		panic(fmt.Sprintf("trailer field %s not declared before streaming the body", field))
+	}
+	if r.trailer == nil {
+		r.trailer = make(http.Header)
+	}
+	r.trailer[field] = append(r.trailer[field], value)
+}
+
+// Flush sends what the handler has written so far, streaming the rest of the
+// body in chunks as if written with WriteChunk.
+func (r *Response) Flush() error {
+	return r.WriteChunk(nil)
+}
+
+// ErrHijacked is returned writing to a response, or hijacking it again, once
+// its connection has been hijacked.
+var ErrHijacked = errors.New("connection has been hijacked")
+
+// Hijack lets the handler take over the connection, to speak another protocol
+// than HTTP with the client. The reader may hold data the client sent
+// already. Nothing more is written by the server: the buffered response is
+// dropped and streaming returns ErrHijacked. The connection is left to the
+// caller to close, the request context being canceled as the handler
+// returns.
+//
+// The connections switched to HTTP/2 can't be hijacked, a request is one
+// stream of the connection there.
+func (r *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if r.conn == nil {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	if r.cr != nil {
+		r.cr.stopBackgroundRead() // the caller reads the connection now
+	}
+	// the deadlines of the server are no concern of the new protocol
+	if err := r.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	r.hijacked = true
+	return r.conn, r.rw, nil
+}
+
+// WriteHeader adds value to the header field, its name canonicalized as
+// "content-type" gives "Content-Type" so that the fields the server sets
+// itself are told apart whatever the case. It panics if field isn't a token
+// or value holds a control character such as CR or LF, which would let
+// whoever chose them forge headers or the body.
 func (r *Response) WriteHeader(field, value string) {
+	checkHeaderField(field, value)
+	r.addHeader(textproto.CanonicalMIMEHeaderKey(field), value)
+}
+
+func (r *Response) addHeader(field, value string) {
 	if r.header == nil {
 		r.header = make(http.Header)
 	}
 	r.header[field] = append(r.header[field], value)
 }
 
-func (r *Response) respond() []byte {
-	statusLine := fmt.Sprintf(`HTTP/1.1 %v OK`, r.status)
-	headers := make([]string, 0, len(r.header))
-	for k, v := range r.header {
+func checkHeaderField(field, value string) {
+	if !isToken(field) {
+		panic(fmt.Sprintf("invalid header field name %q", field))
+	}
+	if !isFieldValue(value) {
+		panic(fmt.Sprintf("invalid value of header field %s: %q", field, value))
+	}
+}
+
+// reasonPhrase returns the canonical reason phrase of code, falling back to a
+// generic phrase of its class when the code is not registered.
+func reasonPhrase(code int) string {
+	if text := http.StatusText(code); text != "" {
+		return text
+	}
+	switch code / 100 {
+	case 1:
+		return "Informational"
+	case 2:
+		return "Success"
+	case 3:
+		return "Redirection"
+	case 4:
+		return "Client Error"
+	case 5:
+		return "Server Error"
+	}
+	return "Unknown"
+}
+
+// addDefaultHeaders adds the Date, Server and default headers of the server the
+// handler didn't set.
+func (r *Response) addDefaultHeaders() {
+	// the configuration of the server is trusted, a panic here being out of
+	// reach of the recovery of handlers
+	if r.header.Get("Date") == "" {
+		r.addHeader("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if _, ok := r.header["Server"]; !ok && r.srv.ServerName != "" {
+		r.addHeader("Server", r.srv.ServerName)
+	}
+	for k, v := range r.srv.DefaultHeaders {
+		k = textproto.CanonicalMIMEHeaderKey(k) // as set in a map literal
+		if _, ok := r.header[k]; ok {
+			continue
+		}
 		for _, vv := range v {
-			headers = append(headers, fmt.Sprintf("%s: %s", k, vv))
+			r.addHeader(k, vv)
 		}
 	}
-	headers = append(headers, fmt.Sprintf("Content-Length: %v", len(r.data)))
+}
 
-	return append([]byte(
-		statusLine+"\n"+
-			strings.Join(headers, "\n")+"\n"+
-			"\n", // new line between header and body
-	), r.data...)
+// headPool recycles the buffers response heads are assembled in, sparing
+// an allocation per response.
+var headPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledHead bounds the buffers kept in headPool, so that a response of
+// huge header doesn't hold its memory for good.
+const maxPooledHead = 64 << 10
+
+// writeHead writes the status line and header of the response. A client
+// waiting for a 100 Continue gets none once the final response is on its
+// way, the body it holds back then closes the connection.
+func (r *Response) writeHead() error {
+	if r.req != nil && r.req.body != nil && r.req.body.expect != nil {
+		r.req.body.expect = nil
+		delete(r.header, "Connection")
+		r.addHeader("Connection", "close")
+	}
+	r.addDefaultHeaders()
+	buf := headPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledHead {
+			buf.Reset()
+			headPool.Put(buf)
+		}
+	}()
+
+	var code [3]byte
+	buf.WriteString("HTTP/1.1 ")
+	buf.Write(strconv.AppendInt(code[:0], int64(r.status), 10))
+	buf.WriteString(" ")
+	buf.WriteString(reasonPhrase(r.status))
+	buf.WriteString("\r\n")
+	writeHeaderLines(buf, r.header, r.srv.SortHeaders)
+	buf.WriteString("\r\n") // empty line between header and body
+	_, err := r.w.Write(buf.Bytes())
+	return err
+}
+
+// writeHeaderLines writes the lines of h, in a single pass over it, sorted
+// by name if asked to. Errors are left to w to remember, as buffers do.
+func writeHeaderLines(w io.StringWriter, h http.Header, sorted bool) {
+	eachHeader(h, sorted, func(k string, v []string) {
+		for _, vv := range v {
+			w.WriteString(k)
+			w.WriteString(": ")
+			w.WriteString(vv)
+			w.WriteString("\r\n")
+		}
+	})
+}
+
+// eachHeader calls f with each field of h, in the random order of the map
+// or, if sorted, in the order of their names.
+func eachHeader(h http.Header, sorted bool, f func(k string, v []string)) {
+	if !sorted {
+		for k, v := range h {
+			f(k, v)
+		}
+		return
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(k, h[k])
+	}
+}
+
+// defaultStatus makes the response a 200 OK if the handler never called
+// WriteStatus, as net/http does.
+func (r *Response) defaultStatus() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+}
+
+// bodyAllowed reports whether a response with status code can have a body,
+// which 1xx, 204 No Content and 304 Not Modified responses can't (RFC 7230
+// section 3.3).
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// prepare completes the header of the buffered response for its body. It
+// reports whether the body is left out, the response being to a HEAD request
+// or of a status without a body. The latter has no Content-Length either.
+func (r *Response) prepare() (noBody bool) {
+	r.defaultStatus()
+	if !bodyAllowed(r.status) {
+		r.data = nil
+		delete(r.header, "Content-Length")
+		delete(r.header, "Transfer-Encoding")
+		return true
+	}
+	isHead := r.req != nil && r.req.Method == http.MethodHead
+	if _, ok := r.header["Content-Type"]; !ok && len(r.data) > 0 && !isHead {
+		r.WriteHeader("Content-Type", http.DetectContentType(r.data)) // looks at 512 bytes at most
+	}
+	if _, ok := r.header["Content-Length"]; !ok || !isHead {
+		// unless the length of the body a GET would get, set by the handler
+		r.compress()
+		delete(r.header, "Content-Length")
+		r.WriteHeader("Content-Length", strconv.Itoa(len(r.data)))
+	}
+	return isHead
+}
+
+// respond writes the buffered response.
+func (r *Response) respond() error {
+	noBody := r.prepare()
+	delete(r.header, "Trailer") // trailers are dropped without chunks
+	if err := r.writeHead(); err != nil {
+		return err
+	}
+	if noBody {
+		// same header as a GET would get for HEAD, but no body
+		return nil
+	}
+	if _, err := r.w.Write(r.data); err != nil {
+		return err
+	}
+	r.size = len(r.data)
+	return nil
+}
+
+// finish writes what remains of the response to the connection: the whole
+// buffered response, or the terminating chunk if the body has been streamed.
+func (r *Response) finish() error {
+	if r.hijacked {
+		return nil // the handler writes its own
+	}
+	if r.sent {
+		return r.w.Flush()
+	}
+	if !r.chunked && len(r.trailer) > 0 {
+		if err := r.WriteChunk(nil); err != nil {
+			return err
+		}
+	}
+
+	if r.chunked {
+		// last chunk, then the trailer section
+		r.w.WriteString("0\r\n")
+		writeHeaderLines(r.w, r.trailer, r.srv.SortHeaders)
+		if _, err := r.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	} else if err := r.respond(); err != nil {
+		return err
+	}
+	return r.w.Flush()
 }
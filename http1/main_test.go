@@ -0,0 +1,1526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoBody replies with the body of the request.
+var echoBody = HandlerFunc(func(resp *Response, req *Request) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.WriteData(b)
+})
+
+func TestMaxBodyBytesChunked(t *testing.T) {
+	readErr := make(chan error, 2)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if len(b) != 10 {
+			t.Errorf("read %q before the limit, want 10 bytes", b)
+		}
+		readErr <- err
+	}), func(srv *Server) { srv.MaxBodyBytes = 10 })
+
+	// the limit is reached in the middle of the third chunk
+	resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"4\r\naaaa\r\n4\r\nbbbb\r\n4\r\ncccc\r\n0\r\n\r\n"+
+		"GET /next HTTP/1.1\r\nHost: x\r\n\r\n")
+	head, _ := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 413 Request Entity Too Large" {
+		t.Errorf("status line = %q, want a 413", got)
+	}
+	if !strings.Contains(head, "\r\nConnection: close\r\n") {
+		t.Errorf("no Connection: close:\n%s", head)
+	}
+	if n := strings.Count(resp, "HTTP/1.1 "); n != 1 {
+		t.Errorf("got %d responses, want the connection closed after the 413:\n%s", n, resp)
+	}
+	if err := <-readErr; err != ErrBodyTooLarge {
+		t.Errorf("read past the limit: %v, want ErrBodyTooLarge", err)
+	}
+}
+
+func TestRequestFraming(t *testing.T) {
+	addr := startServer(t, echoBody, nil)
+	// the request smuggled in the body of the first one is never served
+	const smuggled = "GET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		status string
+		echo   string
+	}{
+		{"content-length and chunked", "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n", "0\r\n\r\n" + smuggled, "HTTP/1.1 400 Bad Request", ""},
+		{"chunked and content-length", "Transfer-Encoding: chunked\r\nContent-Length: 40\r\n", "5\r\nhello\r\n0\r\n\r\n" + smuggled, "HTTP/1.1 400 Bad Request", ""},
+		{"conflicting content-lengths", "Content-Length: 5\r\nContent-Length: 40\r\n", "hello" + smuggled, "HTTP/1.1 400 Bad Request", ""},
+		{"conflicting content-length list", "Content-Length: 5, 40\r\n", "hello" + smuggled, "HTTP/1.1 400 Bad Request", ""},
+		{"equal content-lengths", "Content-Length: 5\r\nContent-Length: 5\r\nConnection: close\r\n", "hello", "HTTP/1.1 200 OK", "hello"},
+		{"equal content-length list", "Content-Length: 5, 5\r\nConnection: close\r\n", "hello", "HTTP/1.1 200 OK", "hello"},
+		{"chunked", "Transfer-Encoding: chunked\r\nConnection: close\r\n", "5\r\nhello\r\n0\r\n\r\n", "HTTP/1.1 200 OK", "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\n"+tt.header+"\r\n"+tt.body)
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if n := strings.Count(resp, "HTTP/1.1 "); n != 1 {
+				t.Errorf("got %d responses, want 1:\n%s", n, resp)
+			}
+			if tt.echo != "" && !strings.HasSuffix(resp, "\r\n\r\n"+tt.echo) {
+				t.Errorf("body not echoed:\n%s", resp)
+			}
+			if tt.echo == "" && !strings.Contains(resp, "Connection: close\r\n") {
+				t.Errorf("rejected without Connection: close:\n%s", resp)
+			}
+		})
+	}
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	var served int32
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		atomic.AddInt32(&served, 1)
+	}), func(srv *Server) { srv.MaxHeaderBytes = 1 << 10 })
+
+	tests := []struct {
+		name   string
+		header string
+		status string
+	}{
+		{"within the limit", "X-A: " + strings.Repeat("a", 900) + "\r\n", "HTTP/1.1 200 OK"},
+		{"one long line", "X-A: " + strings.Repeat("a", 2<<10) + "\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"many lines", strings.Repeat("X-A: a\r\n", 200), "HTTP/1.1 431 Request Header Fields Too Large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&served, 0)
+			resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+tt.header+"\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if ok := tt.status == "HTTP/1.1 200 OK"; (atomic.LoadInt32(&served) == 1) != ok {
+				t.Errorf("handler called %d times", atomic.LoadInt32(&served))
+			}
+		})
+	}
+}
+
+// readHead reads the request line and header of raw with the head reader
+// of srv, returning the header and the status of the error, 0 if none and -1
+// for an error without a status.
+func readHead(srv *Server, raw string) (http.Header, int) {
+	hr := srv.newHeadReader(bufio.NewReader(strings.NewReader(raw)))
+	_, _, _, err := srv.parseRequestLine(hr)
+	var header http.Header
+	if err == nil {
+		header, err = parseMIMEHeader(hr)
+	}
+	var se statusError
+	switch {
+	case err == nil:
+		return header, 0
+	case errors.As(err, &se):
+		return header, se.code
+	}
+	return header, -1
+}
+
+func TestHeadReader(t *testing.T) {
+	const head = "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	tests := []struct {
+		name   string
+		raw    string
+		max    int
+		strict bool
+		code   int
+		want   http.Header
+	}{
+		{"head", head, 0, false, 0, http.Header{"Host": {"x"}}},
+		{"budget of exactly the head", head, len(head), false, 0, http.Header{"Host": {"x"}}},
+		{"budget a byte short", head, len(head) - 1, false, 431, nil},
+		{"budget short of the request line", head, 10, false, 431, nil},
+		{"NUL in a name", "GET / HTTP/1.1\r\nX\x00: a\r\n\r\n", 0, false, 400, nil},
+		{"control character in a value", "GET / HTTP/1.1\r\nX-A: a\x01\r\n\r\n", 0, false, 400, nil},
+		{"bare CR in a value", "GET / HTTP/1.1\r\nX-A: a\rb\r\n\r\n", 0, false, 400, nil},
+		{"bare CR ending a value", "GET / HTTP/1.1\r\nX-A: a\r\r\n\r\n", 0, false, 400, nil},
+		{"bare CR as the blank line", "GET / HTTP/1.1\r\nX-A: a\r\n\r", 0, false, -1, nil},
+		{"obs-fold", "GET / HTTP/1.1\r\nX-A: a\r\n \t b\r\n\tc\r\n\r\n", 0, false, 0, http.Header{"X-A": {"a b c"}}},
+		{"obs-fold of nothing", "GET / HTTP/1.1\r\n X-A: a\r\n\r\n", 0, false, 400, nil},
+		{"obs-fold with a bare CR", "GET / HTTP/1.1\r\nX-A: a\r\n \rb\r\n\r\n", 0, false, 400, nil},
+		{"bare LF", "GET / HTTP/1.1\nX-A: a\n\n", 0, false, 0, http.Header{"X-A": {"a"}}},
+		{"bare LF when strict", "GET / HTTP/1.1\nX-A: a\n\n", 0, true, 400, nil},
+		{"cut short", "GET / HTTP/1.1\r\nX-A: a", 0, false, -1, nil},
+	}
+	for _, tt := range tests {
+		srv := NewServer("", nil)
+		srv.MaxHeaderBytes, srv.StrictCRLF = tt.max, tt.strict
+		header, code := readHead(srv, tt.raw)
+		if code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+			continue
+		}
+		if tt.want != nil && !reflect.DeepEqual(header, tt.want) {
+			t.Errorf("%s: header %q, want %q", tt.name, header, tt.want)
+		}
+	}
+}
+
+func TestRequestLineTooLong(t *testing.T) {
+	uri := func(n int) string { return "/" + strings.Repeat("a", n-1) }
+	tests := []struct {
+		name               string
+		maxLine, maxHeader int
+		uri, header        string
+		status             string
+	}{
+		{"within the limit", 100, 1 << 10, uri(50), "", "HTTP/1.1 200 OK"},
+		{"request line too long", 100, 1 << 10, uri(200), "", "HTTP/1.1 414 Request URI Too Long"},
+		{"headers too large", 100, 1 << 10, uri(50), "X-A: " + strings.Repeat("a", 2<<10) + "\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		// the request line is over both limits, too long before anything
+		{"request line over the head budget too", 100, 60, uri(200), "", "HTTP/1.1 414 Request URI Too Long"},
+		{"request line over the head budget only", 100, 60, uri(70), "", "HTTP/1.1 431 Request Header Fields Too Large"},
+	}
+	for _, tt := range tests {
+		addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {}), func(srv *Server) {
+			srv.MaxRequestLineBytes, srv.MaxHeaderBytes = tt.maxLine, tt.maxHeader
+		})
+		resp := rawRequest(t, addr, "GET "+tt.uri+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+tt.header+"\r\n")
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("%s: status line = %q, want %q", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestHeaderEndless(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		t.Error("request with an endless header served")
+	}), func(srv *Server) { srv.MaxHeaderBytes = 4 << 10 })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n"))
+	// header lines keep coming, the server answers once past its limit
+	go func() {
+		line := []byte("X-A: " + strings.Repeat("a", 100) + "\r\n")
+		for {
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+	resp, _ := bufio.NewReader(conn).ReadString('\n')
+	if resp != "HTTP/1.1 431 Request Header Fields Too Large\r\n" {
+		t.Errorf("status line = %q, want a 431", resp)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+		ok         bool
+	}{
+		{"/", "/", true},
+		{"/a/b", "/a/b", true},
+		{"/a/./b/../c", "/a/c", true},
+		{"/a//b/", "/a/b/", true},
+		{"/a/..", "/", true},
+		{"/a/../", "/", true},
+		{"/..", "", false},
+		{"/../etc/passwd", "", false},
+		{"/static/../../etc/passwd", "", false},
+		{"/a/b/../../../c", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanPath(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanPath(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHeaderControlCharacters(t *testing.T) {
+	var served int32
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		atomic.AddInt32(&served, 1)
+		resp.WriteString(req.Header.Get("X-A"))
+	}), nil)
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"bare CR in a value", "X-A: a\rX-Injected: b\r\n"},
+		{"CR LF in a folded value", "X-A: a\r\n \rX-Injected: b\r\n"},
+		{"CR ending a value", "X-A: a\r\r\n"},
+		{"CR starting a line", "\rX-A: a\r\n"},
+		{"NUL in a value", "X-A: a\x00b\r\n"},
+		{"DEL in a value", "X-A: a\x7fb\r\n"},
+		{"escape in a value", "X-A: a\x1bb\r\n"},
+		{"space before the colon", "X-A : a\r\n"},
+		{"invalid name", "X(A): a\r\n"},
+		{"NUL in a name", "X\x00A: a\r\n"},
+		{"empty name", ": a\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\n"+tt.header+"\r\n")
+			if got := statusLine(resp); got != "HTTP/1.1 400 Bad Request" {
+				t.Errorf("status = %q, want 400", got)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Errorf("handler called %d times", n)
+	}
+
+	// tabs and obs-text are allowed in values
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\tb\xe9\r\nConnection: close\r\n\r\n")
+	if got := statusLine(resp); got != "HTTP/1.1 200 OK" || !strings.HasSuffix(resp, "a\tb\xe9") {
+		t.Errorf("valid value rejected: %q", resp)
+	}
+}
+
+// panics reports whether f panics.
+func panics(f func()) (panicked bool) {
+	defer func() { panicked = recover() != nil }()
+	f()
+	return false
+}
+
+func TestWriteHeaderInjection(t *testing.T) {
+	tests := []struct {
+		field, value string
+	}{
+		{"X-A", "a\r\nX-Forged: b"},
+		{"X-A", "a\nX-Forged: b"},
+		{"X-A", "a\rX-Forged: b"},
+		{"X-A", "a\r\n\r\n<html>forged body"},
+		{"X-A", "a\x00b"},
+		{"X-A\r\nX-Forged", "b"},
+		{"X-A: b\r\nX-Forged", "b"},
+		{"X A", "b"},
+		{"", "b"},
+	}
+	for _, tt := range tests {
+		var resp Response
+		if !panics(func() { resp.WriteHeader(tt.field, tt.value) }) {
+			t.Errorf("WriteHeader(%q, %q) didn't panic", tt.field, tt.value)
+		}
+		if !panics(func() { resp.SetTrailer(tt.field, tt.value) }) {
+			t.Errorf("SetTrailer(%q, %q) didn't panic", tt.field, tt.value)
+		}
+		if len(resp.header) > 0 || len(resp.trailer) > 0 {
+			t.Errorf("WriteHeader(%q, %q) kept the field", tt.field, tt.value)
+		}
+	}
+	var resp Response
+	if panics(func() { resp.WriteHeader("X-A", "a\tb \xe9") }) {
+		t.Error("WriteHeader panicked for a valid value")
+	}
+}
+
+func TestWriteHeaderInjectionServed(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		// echoing the query, a handler would let the client forge headers
+		req.ParseForm()
+		resp.WriteHeader("X-Echo", req.Form.Get("v"))
+		resp.WriteString("ok")
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET /?v=a%0d%0aX-Forged:%20b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if got := statusLine(resp); got != "HTTP/1.1 500 Internal Server Error" {
+		t.Errorf("status = %q, want 500", got)
+	}
+	if strings.Contains(resp, "X-Forged") {
+		t.Errorf("forged header sent:\n%s", resp)
+	}
+}
+
+func TestResponseCRLF(t *testing.T) {
+	const body = "line 1\nline 2\r\n\r\nline 3\n"
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("Content-Type", "text/plain")
+		resp.WriteString(body)
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(resp, "\r\n\r\n") {
+		t.Fatalf("no blank line after the head:\n%q", resp)
+	}
+	head, got := splitResponse(resp)
+	lines := strings.SplitAfter(head, "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.HasSuffix(line, "\r\n") || strings.Count(line, "\r") != 1 {
+			t.Errorf("line %q not ended by a single CRLF", line)
+		}
+	}
+	if got != body {
+		t.Errorf("body = %q, want %q untouched", got, body)
+	}
+}
+
+func TestDateHeader(t *testing.T) {
+	const set = "Sun, 06 Nov 1994 08:49:37 GMT"
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/set" {
+			resp.WriteHeader("Date", set)
+		}
+	}), nil)
+
+	before := time.Now().Truncate(time.Second)
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	date := resp.Header.Get("Date")
+	tm, err := http.ParseTime(date)
+	if err != nil {
+		t.Fatalf("Date %q: %v", date, err)
+	}
+	if got := tm.UTC().Format(http.TimeFormat); got != date {
+		t.Errorf("Date %q formatted back as %q", date, got)
+	}
+	if tm.Before(before) || tm.After(time.Now()) {
+		t.Errorf("Date %q isn't the time of the response", date)
+	}
+
+	resp, err = http.Get("http://" + addr + "/set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header["Date"]; len(got) != 1 || got[0] != set {
+		t.Errorf("Date = %q, want the one of the handler only", got)
+	}
+}
+
+func TestHeadResponse(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/length" {
+			// the length of a body not generated for HEAD
+			resp.WriteHeader("Content-Length", "42")
+			return
+		}
+		resp.WriteString("hello world")
+	}), nil)
+
+	tests := []struct {
+		path, length string
+	}{
+		{"/", "11"},
+		{"/length", "42"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "HEAD "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body := splitResponse(resp)
+		if !strings.Contains(head, "\r\nContent-Length: "+tt.length+"\r\n") {
+			t.Errorf("HEAD %s: no Content-Length of %s:\n%s", tt.path, tt.length, head)
+		}
+		if body != "" {
+			t.Errorf("HEAD %s: body %q sent", tt.path, body)
+		}
+	}
+
+	// the next response on the connection is read right after the head
+	resp := rawRequest(t, addr, "HEAD / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	_, rest := splitResponse(resp)
+	if statusLine(rest) != "HTTP/1.1 200 OK" || !strings.HasSuffix(rest, "\r\n\r\nhello world") {
+		t.Errorf("GET after HEAD = %q", rest)
+	}
+}
+
+func TestHeaderFolding(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Header.Get("User-Agent") + "|" + req.Header.Get("Accept"))
+	}), nil)
+
+	tests := []struct {
+		name   string
+		header string
+		status string
+		echo   string
+	}{
+		{"folded with a space", "User-Agent: Mozilla/5.0\r\n (X11; Linux)\r\nAccept: */*\r\n", "HTTP/1.1 200 OK", "Mozilla/5.0 (X11; Linux)|*/*"},
+		{"folded with tabs", "User-Agent: Mozilla/5.0\r\n\t\t(X11;\r\n\tLinux)\r\n", "HTTP/1.1 200 OK", "Mozilla/5.0 (X11; Linux)|"},
+		{"continuing nothing", " User-Agent: Mozilla/5.0\r\n", "HTTP/1.1 400 Bad Request", ""},
+		{"line without a colon", "User-Agent Mozilla/5.0\r\n", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET / HTTP/1.1\r\n"+tt.header+"Host: x\r\nConnection: close\r\n\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); tt.echo != "" && body != tt.echo {
+				t.Errorf("headers = %q, want %q", body, tt.echo)
+			}
+		})
+	}
+}
+
+func TestMalformedRequestLine(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {}), nil)
+
+	for _, line := range []string{"GET /", "GET", "GET  HTTP/1.1 extra"} {
+		resp := rawRequest(t, addr, line+"\r\nHost: x\r\n\r\n")
+		head, _ := splitResponse(resp)
+		if got := statusLine(resp); got != "HTTP/1.1 400 Bad Request" {
+			t.Errorf("%q: status = %q, want 400", line, got)
+		}
+		if !strings.Contains(head, "\r\nConnection: close\r\n") {
+			t.Errorf("%q: answered without Connection: close:\n%s", line, head)
+		}
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	var resp Response
+	resp.WriteString("héllo")
+	resp.WriteData([]byte{0, '\n'})
+	resp.WriteString("")
+	resp.Writef("%d %s%%", 42, "done")
+	if want := "héllo\x00\n42 done%"; string(resp.data) != want {
+		t.Errorf("data = %q, want %q", resp.data, want)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/", HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path != "/" {
+			NotFound(resp, req)
+			return
+		}
+		resp.Redirect(http.StatusFound, "/home?a=1&b=2")
+	}))
+	mux.Handle("/home", HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString("home")
+	}))
+	addr := startServer(t, mux, nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, body := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 302 Found" {
+		t.Errorf("status = %q, want 302", got)
+	}
+	if !strings.Contains(head, "\r\nLocation: /home?a=1&b=2\r\n") {
+		t.Errorf("no Location of /home:\n%s", head)
+	}
+	if !strings.Contains(body, `href="/home?a=1&amp;b=2"`) {
+		t.Errorf("body doesn't link to /home: %q", body)
+	}
+
+	// followed by a client
+	r, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if string(b) != "home" {
+		t.Errorf("redirect followed to %q, want home", b)
+	}
+
+	for _, code := range []int{http.StatusOK, http.StatusNotModified, http.StatusMultipleChoices, 399} {
+		var resp Response
+		if !panics(func() { resp.Redirect(code, "/home") }) {
+			t.Errorf("Redirect with %d didn't panic", code)
+		}
+	}
+}
+
+func TestHeaderCanonicalKeys(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		resp.Writef("%q %q %q %s", req.Header["Content-Type"], req.Header.Get("content-type"), req.Header["X-Lower-Case"], b)
+	}), nil)
+
+	resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nhost: x\r\ncontent-type: text/plain\r\nx-lower-CASE: a\r\n"+
+		"CONTENT-LENGTH: 5\r\nconnection: close\r\n\r\nhello")
+	want := `["text/plain"] "text/plain" ["a"] hello`
+	if _, body := splitResponse(resp); body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+}
+
+func TestResponseHeaderCanonicalKeys(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("content-type", "text/html")
+		resp.WriteHeader("server", "handler")
+		resp.WriteHeader("x-lower-CASE", "a")
+		resp.WriteString("<p>hello</p>")
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, _ := splitResponse(resp)
+	for _, line := range []string{"Content-Type: text/html", "Server: handler", "X-Lower-Case: a", "Content-Length: 12"} {
+		if !strings.Contains(head, "\r\n"+line+"\r\n") {
+			t.Errorf("no %s:\n%s", line, head)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Server", "Content-Length"} {
+		if n := strings.Count(strings.ToLower(head), "\r\n"+strings.ToLower(name)+":"); n != 1 {
+			t.Errorf("%d %s lines, want 1:\n%s", n, name, head)
+		}
+	}
+}
+
+// echoTarget replies with the host, request URI and path of the request.
+var echoTarget = HandlerFunc(func(resp *Response, req *Request) {
+	resp.WriteString(req.Host + " " + req.RequestURI + " " + req.Path)
+})
+
+func TestRequestTarget(t *testing.T) {
+	addr := startServer(t, echoTarget, nil)
+
+	tests := []struct {
+		name, target, host string
+		status, echo       string
+	}{
+		{"origin-form", "/p%20a?q=1", "example.com", "HTTP/1.1 200 OK", "example.com /p%20a?q=1 /p a"},
+		{"absolute-form", "http://example.com:8080/p?q=1", "other.com", "HTTP/1.1 200 OK", "example.com:8080 /p?q=1 /p"},
+		{"absolute-form https", "https://example.com", "example.com", "HTTP/1.1 200 OK", "example.com / /"},
+		{"absolute-form without host", "http:///p", "example.com", "HTTP/1.1 400 Bad Request", ""},
+		{"absolute-form of another scheme", "ftp://example.com/p", "example.com", "HTTP/1.1 400 Bad Request", ""},
+		{"neither form", "p", "example.com", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET "+tt.target+" HTTP/1.1\r\nHost: "+tt.host+"\r\nConnection: close\r\n\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); tt.echo != "" && body != tt.echo {
+				t.Errorf("host, URI and path = %q, want %q", body, tt.echo)
+			}
+		})
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	addr := startServer(t, echoTarget, nil)
+
+	tests := []struct {
+		name, request, status, echo string
+	}{
+		{"single", "GET / HTTP/1.1\r\nHost: example.com\r\n", "HTTP/1.1 200 OK", "example.com / /"},
+		{"missing", "GET / HTTP/1.1\r\n", "HTTP/1.1 400 Bad Request", ""},
+		{"duplicate", "GET / HTTP/1.1\r\nHost: example.com\r\nHost: other.com\r\n", "HTTP/1.1 400 Bad Request", ""},
+		{"duplicate and equal", "GET / HTTP/1.1\r\nHost: example.com\r\nHost: example.com\r\n", "HTTP/1.1 400 Bad Request", ""},
+		{"missing from HTTP/1.0", "GET / HTTP/1.0\r\n", "HTTP/1.1 200 OK", " / /"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, tt.request+"Connection: close\r\n\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); tt.echo != "" && body != tt.echo {
+				t.Errorf("host, URI and path = %q, want %q", body, tt.echo)
+			}
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/set" {
+			resp.WriteHeader("Server", "custom/1.0")
+		}
+	})
+	tests := []struct {
+		name, serverName, path string
+		want                   []string
+	}{
+		{"default", "http-explained/0.1", "/", []string{"http-explained/0.1"}},
+		{"set by the handler", "http-explained/0.1", "/set", []string{"custom/1.0"}},
+		{"suppressed", "", "/", nil},
+		{"set by the handler without a default", "", "/set", []string{"custom/1.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startServer(t, h, func(srv *Server) { srv.ServerName = tt.serverName })
+			resp, err := http.Get("http://" + addr + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header["Server"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Server = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, and the
+// pool of roots to verify it with.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "http-explained test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+func TestTLS(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		if req.TLS == nil {
+			resp.WriteString("plaintext")
+			return
+		}
+		resp.Writef("TLS %x", req.TLS.Version)
+	})
+	cert, roots := testCertificate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(l.Addr().String(), h)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	srv.AccessLogFormat = nil
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(tls.NewListener(l, srv.TLSConfig)) }()
+	defer func() {
+		srv.Shutdown()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := string(b); statusLine(resp) != "HTTP/1.1 200 OK" || !strings.HasSuffix(resp, "\r\n\r\nTLS 303") {
+		t.Errorf("response over TLS 1.2 = %q", resp)
+	}
+
+	resp := rawRequest(t, startServer(t, h, nil), "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.HasSuffix(resp, "\r\n\r\nplaintext") {
+		t.Errorf("response in plaintext = %q", resp)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	canceled := make(chan error, 1)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			canceled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+	}), nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	conn.Close()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("context error = %v once the client is gone, want context.Canceled", err)
+	}
+
+	// a request sent while the handler runs is read once it returns
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "HTTP/1.1 200 OK\r\n"); n != 2 {
+		t.Errorf("%d responses to the two requests:\n%s", n, b)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"struct", struct {
+			Name string `json:"name"`
+			Age  int    `json:"age"`
+		}{"gopher", 13}, `{"name":"gopher","age":13}`},
+		{"map", map[string]any{"b": []int{1, 2}, "a": nil}, `{"a":null,"b":[1,2]}`},
+	}
+	for _, tt := range tests {
+		var resp Response
+		if err := resp.WriteJSON(tt.v); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(resp.data) != tt.want {
+			t.Errorf("%s: body = %s, want %s", tt.name, resp.data, tt.want)
+		}
+		if got := resp.header.Get("Content-Type"); got != "application/json; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q", tt.name, got)
+		}
+	}
+
+	var resp Response
+	if err := resp.WriteJSON(map[string]any{"ok": 1, "bad": make(chan int)}); err == nil {
+		t.Error("WriteJSON of a channel: no error")
+	}
+	if len(resp.data) > 0 || len(resp.header) > 0 {
+		t.Errorf("WriteJSON wrote %q, %v on error", resp.data, resp.header)
+	}
+}
+
+func TestRequestLineEnding(t *testing.T) {
+	echoProto := HandlerFunc(func(resp *Response, req *Request) {
+		resp.Writef("%q %q", req.Proto, req.Header.Get("Host"))
+	})
+	addr := startServer(t, echoProto, nil)
+	strict := startServer(t, echoProto, func(srv *Server) { srv.StrictCRLF = true })
+
+	tests := []struct {
+		name, addr, request, status, echo string
+	}{
+		{"CRLF", addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "HTTP/1.1 200 OK", `"HTTP/1.1" "x"`},
+		{"bare LF", addr, "GET / HTTP/1.1\nHost: x\nConnection: close\n\n", "HTTP/1.1 200 OK", `"HTTP/1.1" "x"`},
+		{"strict CRLF", strict, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "HTTP/1.1 200 OK", `"HTTP/1.1" "x"`},
+		{"strict bare LF request line", strict, "GET / HTTP/1.1\nHost: x\r\n\r\n", "HTTP/1.1 400 Bad Request", ""},
+		{"strict bare LF header line", strict, "GET / HTTP/1.1\r\nHost: x\n\r\n", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, tt.addr, tt.request)
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); tt.echo != "" && body != tt.echo {
+				t.Errorf("proto and host = %s, want %s", body, tt.echo)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		switch req.Path {
+		case "/declared":
+			// declared by the handler, set once streaming
+			resp.WriteHeader("Trailer", "X-Checksum")
+			resp.WriteChunk([]byte("hello "))
+			resp.SetTrailer("X-Checksum", "abc")
+		case "/undeclared":
+			resp.WriteChunk([]byte("hello "))
+			if !panics(func() { resp.SetTrailer("X-Checksum", "abc") }) {
+				t.Error("SetTrailer of an undeclared field didn't panic once streaming")
+			}
+		default:
+			// declared along with the head
+			resp.SetTrailer("X-Checksum", "abc")
+			resp.SetTrailer("X-Count", "2")
+		}
+		resp.WriteString("world")
+	}), nil)
+
+	tests := []struct {
+		path, trailer string
+		want          textproto.MIMEHeader
+	}{
+		{"/", "X-Checksum, X-Count", textproto.MIMEHeader{"X-Checksum": {"abc"}, "X-Count": {"2"}}},
+		{"/declared", "X-Checksum", textproto.MIMEHeader{"X-Checksum": {"abc"}}},
+		{"/undeclared", "", textproto.MIMEHeader{}},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body := splitResponse(resp)
+		if !strings.Contains(head, "\r\nTransfer-Encoding: chunked\r\n") {
+			t.Fatalf("%s: not chunked:\n%s", tt.path, head)
+		}
+		if tt.trailer != "" && !strings.Contains(head, "\r\nTrailer: "+tt.trailer+"\r\n") {
+			t.Errorf("%s: no Trailer of %s:\n%s", tt.path, tt.trailer, head)
+		}
+		i := strings.Index(body, "\r\n0\r\n")
+		if i < 0 {
+			t.Fatalf("%s: no last chunk: %q", tt.path, body)
+		}
+		trailer, err := textproto.NewReader(bufio.NewReader(strings.NewReader(body[i+len("\r\n0\r\n"):]))).ReadMIMEHeader()
+		if err != nil {
+			t.Fatalf("%s: read the trailers: %v", tt.path, err)
+		}
+		if !reflect.DeepEqual(trailer, tt.want) {
+			t.Errorf("%s: trailers = %v, want %v", tt.path, trailer, tt.want)
+		}
+	}
+
+	// dropped without chunks
+	resp := rawRequest(t, addr, "GET / HTTP/1.0\r\n\r\n")
+	if head, body := splitResponse(resp); strings.Contains(head, "Trailer") || body != "world" {
+		t.Errorf("HTTP/1.0 response = %q, want the body alone", resp)
+	}
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	srv := NewServer("", nil)
+	tests := []struct {
+		name, method, set, body, want string
+	}{
+		{"html", http.MethodGet, "", "<!DOCTYPE html><html><body>hi", "text/html; charset=utf-8"},
+		{"png", http.MethodGet, "", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"plain text", http.MethodGet, "", "just some text", "text/plain; charset=utf-8"},
+		{"set by the handler", http.MethodGet, "application/json", "<html>", "application/json"},
+		{"empty", http.MethodGet, "", "", ""},
+		{"head", http.MethodHead, "", "<html>", ""},
+	}
+	for _, tt := range tests {
+		resp := Response{req: &Request{Method: tt.method}, srv: srv}
+		if tt.set != "" {
+			resp.WriteHeader("Content-Type", tt.set)
+		}
+		resp.WriteString(tt.body)
+		resp.prepare()
+		if got := resp.header.Get("Content-Type"); got != tt.want {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Proto)
+	}), nil)
+
+	tests := []struct {
+		proto, status, echo string
+	}{
+		{"HTTP/2.0", "HTTP/1.1 505 HTTP Version Not Supported", ""},
+		{"HTTP/3.0", "HTTP/1.1 505 HTTP Version Not Supported", ""},
+		{"HTTP/0.9", "HTTP/1.1 505 HTTP Version Not Supported", ""},
+		{"HTTP/1.2", "HTTP/1.1 200 OK", "HTTP/1.1"},
+		{"HTTP/1.0", "HTTP/1.1 200 OK", "HTTP/1.0"},
+		{"HTTPS/1.1", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET / "+tt.proto+"\r\nHost: x\r\nConnection: close\r\n\r\n")
+			head, body := splitResponse(resp)
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if tt.echo != "" && body != tt.echo {
+				t.Errorf("proto = %q, want %q", body, tt.echo)
+			}
+			if tt.echo == "" && !strings.Contains(head, "\r\nConnection: close\r\n") {
+				t.Errorf("rejected without Connection: close:\n%s", head)
+			}
+		})
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		name, body, contentLength string
+		want                      string
+		err                       error
+	}{
+		{"under the limit", "hello", "", "hello", nil},
+		{"at the limit", "hello, wor", "10", "hello, wor", nil},
+		{"empty", "", "", "", nil},
+		{"over the limit", "hello, world", "", "hello, wor", ErrBodyTooLarge},
+		{"announced over the limit", "hello, world", "12", "", ErrBodyTooLarge},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(tt.body)
+		req := &Request{Header: make(http.Header), Body: ioutil.NopCloser(body)}
+		if tt.contentLength != "" {
+			req.Header.Set("Content-Length", tt.contentLength)
+		}
+		b, err := req.ReadBody(10)
+		if string(b) != tt.want || err != tt.err {
+			t.Errorf("%s: ReadBody(10) = %q, %v, want %q, %v", tt.name, b, err, tt.want, tt.err)
+		}
+		if tt.contentLength == "12" && body.Len() != len(tt.body) {
+			t.Errorf("%s: body read", tt.name)
+		}
+	}
+}
+
+func TestMakeBodyReadCloser(t *testing.T) {
+	srv := NewServer("", nil)
+	const next = "GET /next HTTP/1.1\r\n"
+	tests := []struct {
+		name   string
+		header http.Header
+		input  string
+		empty  bool
+		want   string
+	}{
+		{"absent", http.Header{}, next, true, ""},
+		{"zero length", http.Header{"Content-Length": {"0"}}, next, true, ""},
+		{"fixed length", http.Header{"Content-Length": {"5"}}, "hello" + next, false, "hello"},
+		{"chunked", http.Header{"Transfer-Encoding": {"chunked"}}, "5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n" + next, false, "hello!"},
+		{"chunked and empty", http.Header{"Transfer-Encoding": {"chunked"}}, "0\r\n\r\n" + next, false, ""},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.input))
+		b, err := srv.makeBodyReadCloser(r, tt.header)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if b.empty() != tt.empty {
+			t.Errorf("%s: empty() = %v, want %v", tt.name, b.empty(), tt.empty)
+		}
+		got, err := ioutil.ReadAll(b)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: body = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+		// the body ends where the next request begins
+		if rest, _ := ioutil.ReadAll(r); string(rest) != next {
+			t.Errorf("%s: left %q after the body, want the next request", tt.name, rest)
+		}
+	}
+}
+
+func TestHasConnectionToken(t *testing.T) {
+	tests := []struct {
+		connection []string
+		tok        string
+		want       bool
+	}{
+		{[]string{"close"}, "close", true},
+		{[]string{"keep-alive, Upgrade"}, "upgrade", true},
+		{[]string{"Keep-Alive,CLOSE"}, "close", true},
+		{[]string{"keep-alive", " Upgrade "}, "Upgrade", true},
+		{[]string{"keep-alive, , upgrade,"}, "upgrade", true},
+		{[]string{"closed"}, "close", false},
+		{[]string{"keep-alive, upgrade"}, "close", false},
+		{nil, "close", false},
+	}
+	for _, tt := range tests {
+		req := &Request{Header: http.Header{"Connection": tt.connection}}
+		if got := req.hasConnectionToken(tt.tok); got != tt.want {
+			t.Errorf("hasConnectionToken(%q) of %q = %v, want %v", tt.tok, tt.connection, got, tt.want)
+		}
+	}
+	if got := headerTokens(http.Header{"Connection": {"Keep-Alive, Upgrade", "close"}}, "Connection"); !reflect.DeepEqual(got, []string{"keep-alive", "upgrade", "close"}) {
+		t.Errorf("headerTokens = %q", got)
+	}
+}
+
+func TestRequestPathDecoding(t *testing.T) {
+	addr := startServer(t, echoTarget, nil)
+
+	tests := []struct {
+		name, target, status, echo string
+	}{
+		{"space", "/files/a%20b.txt", "HTTP/1.1 200 OK", "x /files/a%20b.txt /files/a b.txt"},
+		{"encoded slash", "/files/a%2Fb.txt", "HTTP/1.1 200 OK", "x /files/a%2Fb.txt /files/a/b.txt"},
+		{"query left encoded", "/a%20b?q=%20", "HTTP/1.1 200 OK", "x /a%20b?q=%20 /a b"},
+		{"invalid escape", "/files/%zz", "HTTP/1.1 400 Bad Request", ""},
+		{"truncated escape", "/files/%2", "HTTP/1.1 400 Bad Request", ""},
+		{"NUL", "/files/a%00b", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET "+tt.target+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+			if got := statusLine(resp); got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+			if _, body := splitResponse(resp); tt.echo != "" && body != tt.echo {
+				t.Errorf("host, URI and path = %q, want %q", body, tt.echo)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want url.Values
+	}{
+		{"/search?q=go&page=2", url.Values{"q": {"go"}, "page": {"2"}}},
+		{"/?a=1&a=2&b", url.Values{"a": {"1", "2"}, "b": {""}}},
+		{"/?k%20ey=v%26al+ue&empty=", url.Values{"k ey": {"v&al ue"}, "empty": {""}}},
+		{"/?a=1&bad=%zz&c=3", url.Values{"a": {"1"}, "c": {"3"}}},
+		{"/?", url.Values{}},
+		{"/search", url.Values{}},
+	}
+	for _, tt := range tests {
+		req := &Request{RequestURI: tt.uri}
+		if got := req.Query(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Query() = %v, want %v", tt.uri, got, tt.want)
+		}
+	}
+
+	// the values are parsed once
+	req := &Request{RequestURI: "/?q=go"}
+	req.Query().Set("q", "changed")
+	if got := req.Query().Get("q"); got != "changed" {
+		t.Errorf("Query() not cached: q = %q", got)
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		switch req.Path {
+		case "/override":
+			resp.WriteHeader("X-Frame-Options", "SAMEORIGIN")
+			resp.WriteHeader("Vary", "Origin")
+			resp.WriteHeader("Vary", "Cookie")
+		case "/lower":
+			resp.WriteHeader("x-frame-options", "SAMEORIGIN")
+		}
+	}), func(srv *Server) {
+		srv.DefaultHeaders = http.Header{
+			"x-content-type-options": {"nosniff"}, // not canonical
+			"X-Frame-Options":        {"DENY"},
+			"Vary":                   {"Accept-Encoding", "Accept-Language"},
+		}
+	})
+
+	tests := []struct {
+		path string
+		want http.Header
+	}{
+		{"/", http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"DENY"},
+			"Vary":                   {"Accept-Encoding", "Accept-Language"},
+		}},
+		{"/override", http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"SAMEORIGIN"},
+			"Vary":                   {"Origin", "Cookie"},
+		}},
+		{"/lower", http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"SAMEORIGIN"},
+		}},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get("http://" + addr + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for k, want := range tt.want {
+			if got := resp.Header[k]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s = %q, want %q", tt.path, k, got, want)
+			}
+		}
+	}
+}
+
+func TestBodyPartiallyRead(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		var b [3]byte
+		n, _ := io.ReadFull(req.Body, b[:])
+		if req.Path == "/close" {
+			req.Body.Close()
+			if m, err := req.Body.Read(b[:]); m != 0 || err == nil {
+				t.Errorf("read %d, %v once closed", m, err)
+			}
+		}
+		resp.Writef("%s %s;", req.Path, b[:n])
+	}), nil)
+
+	resp := rawRequest(t, addr, "POST /read HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n\r\nhello world"+
+		"POST /close HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n\r\nhello world"+
+		"POST /chunked HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"+
+		"POST /close HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"+
+		"GET /last HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	var bodies []string
+	for _, r := range strings.Split(resp, "HTTP/1.1 ")[1:] {
+		_, body := splitResponse(r)
+		bodies = append(bodies, body)
+	}
+	if got, want := strings.Join(bodies, ""), "/read hel;/close hel;/chunked hel;/close hel;/last ;"; got != want {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+}
+
+func TestBodylessStatus(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(req.Path, "/"))
+		resp.WriteStatus(code)
+		if code != http.StatusOK {
+			// dropped for a status without a body
+			resp.WriteHeader("Content-Length", "4")
+			resp.WriteString("body")
+		}
+	}), nil)
+
+	tests := []struct {
+		code          string
+		contentLength bool
+	}{
+		{"204", false},
+		{"304", false},
+		{"200", true},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET /"+tt.code+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body := splitResponse(resp)
+		if !strings.HasPrefix(head, "HTTP/1.1 "+tt.code+" ") {
+			t.Errorf("status line = %q, want %s", statusLine(resp), tt.code)
+		}
+		if body != "" {
+			t.Errorf("%s: body %q sent", tt.code, body)
+		}
+		if got := strings.Contains(head, "\r\nContent-Length: "); got != tt.contentLength {
+			t.Errorf("%s: Content-Length sent %v, want %v:\n%s", tt.code, got, tt.contentLength, head)
+		}
+		if tt.contentLength && !strings.Contains(head, "\r\nContent-Length: 0\r\n") {
+			t.Errorf("%s: no Content-Length of 0:\n%s", tt.code, head)
+		}
+	}
+}
+
+func TestImplicitStatus(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/data" {
+			resp.WriteData([]byte("no status"))
+		}
+	}), nil)
+
+	for _, path := range []string{"/data", "/empty"} {
+		resp := rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if got := statusLine(resp); got != "HTTP/1.1 200 OK" {
+			t.Errorf("%s: status line = %q, want a 200", path, got)
+		}
+	}
+}
+
+func TestResponseWrite(t *testing.T) {
+	var _ io.Writer = (*Response)(nil)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		fmt.Fprintf(resp, "%s;", req.Path)
+		if req.Path == "/stream" {
+			resp.Flush()
+		}
+		json.NewEncoder(resp).Encode(map[string]int{"n": 1})
+	}), nil)
+
+	tests := []struct {
+		path    string
+		chunked bool
+	}{
+		{"/buffered", false},
+		{"/stream", true},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get("http://" + addr + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.path + ";{\"n\":1}\n"; string(b) != want {
+			t.Errorf("%s: body = %q, want %q", tt.path, b, want)
+		}
+		if chunked := len(resp.TransferEncoding) > 0; chunked != tt.chunked {
+			t.Errorf("%s: chunked %v, want %v", tt.path, chunked, tt.chunked)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startServer(t, echoBody, func(srv *Server) { srv.MaxBodyBytes = 10 })
+
+	tests := []struct {
+		name, req, status string
+		continued         bool
+	}{
+		// the body is never sent, the server has to answer without it
+		{"body too large", "Content-Length: 11\r\nExpect: 100-continue\r\n\r\n", "413 Request Entity Too Large", false},
+		{"unsupported expectation", "Content-Length: 5\r\nExpect: something\r\n\r\n", "417 Expectation Failed", false},
+		{"body fitting", "Content-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\nhello", "200 OK", true},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\n"+tt.req)
+		if got := strings.Contains(resp, "100 Continue"); got != tt.continued {
+			t.Errorf("%s: 100 Continue sent %v, want %v:\n%s", tt.name, got, tt.continued, resp)
+		}
+		if tt.continued {
+			resp = resp[strings.Index(resp, "\r\n\r\n")+4:]
+		}
+		if got := statusLine(resp); got != "HTTP/1.1 "+tt.status {
+			t.Errorf("%s: status line = %q, want %s", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestHeaderlessRequest(t *testing.T) {
+	addr := startServer(t, echoTarget, nil)
+
+	tests := []struct {
+		name, req string
+		served    bool
+	}{
+		{"blank line", "GET /a HTTP/1.0\r\n\r\n", true},
+		{"EOF after the request line", "GET /a HTTP/1.0\r\n", true},
+		{"EOF after a header line", "GET /a HTTP/1.0\r\nHost: x\r\n", true},
+		{"HTTP/1.1 EOF after the request line", "GET /a HTTP/1.1\r\nHost: x\r\n", false},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(tt.req))
+		// the client closes its side right after
+		conn.(*net.TCPConn).CloseWrite()
+		b, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp := string(b)
+		if served := statusLine(resp) == "HTTP/1.1 200 OK"; served != tt.served {
+			t.Errorf("%s: served %v, want %v:\n%s", tt.name, served, tt.served, resp)
+		}
+		if tt.served && !strings.Contains(resp, "/a") {
+			t.Errorf("%s: body = %q, want the path", tt.name, resp)
+		}
+	}
+}
+
+func TestTransferCodings(t *testing.T) {
+	addr := startServer(t, echoBody, nil)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	chunk := func(b []byte) string {
+		return fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(b), b)
+	}
+
+	tests := []struct {
+		te, body, status, want string
+	}{
+		{"chunked", chunk([]byte("hello")), "200 OK", "hello"},
+		{"gzip, chunked", chunk(gz.Bytes()), "200 OK", "hello"},
+		{"gzip", "", "400 Bad Request", ""},
+		{"chunked, gzip", chunk(gz.Bytes()), "400 Bad Request", ""},
+		{"chunked, chunked", chunk([]byte("hello")), "400 Bad Request", ""},
+		{"br, chunked", chunk([]byte("hello")), "501 Not Implemented", ""},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nTransfer-Encoding: "+tt.te+"\r\n\r\n"+tt.body)
+		if got := statusLine(resp); got != "HTTP/1.1 "+tt.status {
+			t.Errorf("%s: status line = %q, want %s", tt.te, got, tt.status)
+			continue
+		}
+		if _, body := splitResponse(resp); tt.want != "" && body != tt.want {
+			t.Errorf("%s: body = %q, want %q", tt.te, body, tt.want)
+		}
+	}
+}
+
+func TestWriteInformational(t *testing.T) {
+	errs := make(chan error, 2)
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteInformational(http.StatusEarlyHints, http.Header{"Link": {"</a.css>; rel=preload"}})
+		resp.WriteInformational(http.StatusEarlyHints, http.Header{"Link": {"</b.js>; rel=preload"}})
+		resp.WriteString("final")
+		resp.Flush()
+		errs <- resp.WriteInformational(http.StatusEarlyHints, nil)
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	want := []string{
+		"HTTP/1.1 103 Early Hints\r\nLink: </a.css>; rel=preload\r\n\r\n",
+		"HTTP/1.1 103 Early Hints\r\nLink: </b.js>; rel=preload\r\n\r\n",
+		"HTTP/1.1 200 OK\r\n",
+	}
+	rest := resp
+	for _, w := range want {
+		if !strings.HasPrefix(rest, w) {
+			t.Fatalf("want %q next, got:\n%s", w, rest)
+		}
+		rest = rest[len(w):]
+	}
+	if !strings.Contains(rest, "final") {
+		t.Errorf("final body missing:\n%s", resp)
+	}
+	if err := <-errs; err == nil {
+		t.Error("WriteInformational after the head was sent: no error")
+	}
+
+	// HTTP/1.0 clients get the final response only
+	resp = rawRequest(t, addr, "GET / HTTP/1.0\r\n\r\n")
+	if statusLine(resp) != "HTTP/1.1 200 OK" || strings.Contains(resp, "103") {
+		t.Errorf("HTTP/1.0 response:\n%s", resp)
+	}
+	<-errs
+
+	for _, code := range []int{99, 101, 200} {
+		r := &Response{}
+		if !panics(func() { r.WriteInformational(code, nil) }) {
+			t.Errorf("WriteInformational(%d) didn't panic", code)
+		}
+	}
+}
+
+// BenchmarkRespond measures writing a small buffered response, its head
+// assembled in a pooled buffer.
+func BenchmarkRespond(b *testing.B) {
+	srv := NewServer("", nil)
+	req := &Request{Method: http.MethodGet, Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1}
+	w := bufio.NewWriter(ioutil.Discard)
+	body := []byte("hello, world\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp := Response{w: w, req: req, srv: srv}
+		resp.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+		resp.WriteData(body)
+		if err := resp.finish(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteHeaderLinesSorted(t *testing.T) {
+	h := http.Header{
+		"Vary":         {"Accept-Encoding"},
+		"Content-Type": {"text/plain"},
+		"Set-Cookie":   {"a=1", "b=2"},
+	}
+	var buf bytes.Buffer
+	writeHeaderLines(&buf, h, true)
+	want := "Content-Type: text/plain\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nVary: Accept-Encoding\r\n"
+	if got := buf.String(); got != want {
+		t.Errorf("header lines = %q, want %q", got, want)
+	}
+}
+
+func TestSortHeaders(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		for _, k := range []string{"X-D", "X-B", "X-A", "X-C", "X-E"} {
+			resp.WriteHeader(k, "1")
+		}
+		resp.WriteString("body")
+	}), func(srv *Server) { srv.SortHeaders = true })
+
+	var first []string
+	for i := 0; i < 10; i++ {
+		head, _ := splitResponse(rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+		var names []string
+		for _, line := range strings.Split(head, "\r\n")[1:] {
+			if name, _, ok := strings.Cut(line, ":"); ok {
+				names = append(names, name)
+			}
+		}
+		if !sort.StringsAreSorted(names) {
+			t.Fatalf("header lines not sorted: %q", names)
+		}
+		if first == nil {
+			first = names
+		} else if !reflect.DeepEqual(names, first) {
+			t.Fatalf("header lines %q, then %q", first, names)
+		}
+	}
+}
+
+// BenchmarkWriteHeaderLines measures the allocations of writing a header,
+// none being expected unless it is sorted.
+func BenchmarkWriteHeaderLines(b *testing.B) {
+	h := http.Header{
+		"Content-Type":   {"text/html; charset=utf-8"},
+		"Content-Length": {"1024"},
+		"Connection":     {"keep-alive"},
+		"Date":           {"Wed, 14 Oct 2026 05:00:00 GMT"},
+		"Server":         {"http-explained/0.1"},
+		"Set-Cookie":     {"a=1", "b=2"},
+	}
+	for _, sorted := range []bool{false, true} {
+		name := "unsorted"
+		if sorted {
+			name = "sorted"
+		}
+		b.Run(name, func(b *testing.B) {
+			w := bufio.NewWriter(ioutil.Discard)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				writeHeaderLines(w, h, sorted)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics counts what the server does. The fields are updated atomically.
+type Metrics struct {
+	ConnsAccepted    int64
+	RequestsServed   int64
+	RequestsInFlight int64
+	BytesWritten     int64 // to connections, heads included
+}
+
+// ServeHTTP renders the metrics as plain text.
+func (m *Metrics) ServeHTTP(resp *Response, req *Request) {
+	resp.WriteStatus(http.StatusOK)
+	resp.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+	resp.Writef("conns_accepted %d\n", atomic.LoadInt64(&m.ConnsAccepted))
+	resp.Writef("requests_served %d\n", atomic.LoadInt64(&m.RequestsServed))
+	resp.Writef("requests_in_flight %d\n", atomic.LoadInt64(&m.RequestsInFlight))
+	resp.Writef("bytes_written %d\n", atomic.LoadInt64(&m.BytesWritten))
+}
+
+// countingConn counts the bytes written to the connection in BytesWritten.
+type countingConn struct {
+	net.Conn
+	m *Metrics
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.m.BytesWritten, int64(n))
+	return n, err
+}
+
+func (m *Metrics) String() string {
+	return fmt.Sprintf("%d connections, %d requests (%d in flight), %d bytes written",
+		atomic.LoadInt64(&m.ConnsAccepted), atomic.LoadInt64(&m.RequestsServed),
+		atomic.LoadInt64(&m.RequestsInFlight), atomic.LoadInt64(&m.BytesWritten))
+}
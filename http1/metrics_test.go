@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := NewServer("", nil)
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	srv.AccessLogFormat = nil
+	var inFlight int64
+	srv.Handler = HandlerFunc(func(resp *Response, req *Request) {
+		atomic.StoreInt64(&inFlight, atomic.LoadInt64(&srv.metrics.RequestsInFlight))
+		resp.WriteString("ok")
+	})
+
+	// a fake connection served as one accepted
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.handleConn(conn)
+	}()
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	resp, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	m := srv.Metrics()
+	if got := atomic.LoadInt64(&inFlight); got != 1 {
+		t.Errorf("requests in flight while serving = %d, want 1", got)
+	}
+	if got := atomic.LoadInt64(&m.RequestsInFlight); got != 0 {
+		t.Errorf("requests in flight = %d, want 0", got)
+	}
+	if got := atomic.LoadInt64(&m.RequestsServed); got != 2 {
+		t.Errorf("requests served = %d, want 2", got)
+	}
+	if got := atomic.LoadInt64(&m.BytesWritten); got != int64(len(resp)) {
+		t.Errorf("bytes written = %d, want the %d bytes read", got, len(resp))
+	}
+
+	var r Response
+	m.ServeHTTP(&r, &Request{})
+	want := "requests_served 2\nrequests_in_flight 0\nbytes_written "
+	if !strings.Contains(string(r.data), want) {
+		t.Errorf("metrics rendered as %q", r.data)
+	}
+}
+
+func TestMetricsConnsAccepted(t *testing.T) {
+	var srv *Server
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {}), func(s *Server) { srv = s })
+	for i := 0; i < 3; i++ {
+		rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	}
+	if got := atomic.LoadInt64(&srv.Metrics().ConnsAccepted); got != 3 {
+		t.Errorf("connections accepted = %d, want 3", got)
+	}
+}
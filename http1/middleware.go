@@ -0,0 +1,14 @@
+package main
+
+// Middleware wraps a Handler with some behavior of its own.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mw, the first middleware being the outermost:
+// Chain(h, a, b) is a(b(h)), so a request goes through a then b before h, and
+// the response through b then a.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// marker is a middleware writing name before and after the handler it wraps.
+func marker(name string) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(resp *Response, req *Request) {
+			resp.WriteString(name + "<")
+			h.ServeHTTP(resp, req)
+			resp.WriteString(">" + name)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) { resp.WriteString("h") })
+	tests := []struct {
+		mw   []Middleware
+		want string
+	}{
+		{nil, "h"},
+		{[]Middleware{marker("a")}, "a<h>a"},
+		{[]Middleware{marker("a"), marker("b")}, "a<b<h>b>a"},
+	}
+	for _, tt := range tests {
+		var resp Response
+		Chain(h, tt.mw...).ServeHTTP(&resp, &Request{})
+		if string(resp.data) != tt.want {
+			t.Errorf("got %q, want %q", resp.data, tt.want)
+		}
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := AccessEntry{
+		RemoteAddr: "127.0.0.1:52044",
+		Method:     "GET",
+		RequestURI: "/search?q=go",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Size:       11,
+		Duration:   1500 * time.Microsecond,
+	}
+	noAddr := e
+	noAddr.RemoteAddr = ""
+	withID := e
+	withID.RequestID = "abc-123"
+
+	tests := []struct {
+		name       string
+		e          AccessEntry
+		text, json string
+	}{
+		{"entry", e,
+			`127.0.0.1:52044 "GET /search?q=go HTTP/1.1" 200 11 1.5ms`,
+			`{"remote_addr":"127.0.0.1:52044","method":"GET","request_uri":"/search?q=go","proto":"HTTP/1.1","status":200,"size":11,"duration_ms":1.5}`},
+		{"no remote address", noAddr,
+			`- "GET /search?q=go HTTP/1.1" 200 11 1.5ms`,
+			`{"remote_addr":"","method":"GET","request_uri":"/search?q=go","proto":"HTTP/1.1","status":200,"size":11,"duration_ms":1.5}`},
+		{"request ID", withID,
+			`127.0.0.1:52044 "GET /search?q=go HTTP/1.1" 200 11 1.5ms abc-123`,
+			`{"remote_addr":"127.0.0.1:52044","method":"GET","request_uri":"/search?q=go","proto":"HTTP/1.1","status":200,"size":11,"duration_ms":1.5,"request_id":"abc-123"}`},
+	}
+	for _, tt := range tests {
+		if got := TextAccessLog(tt.e); got != tt.text {
+			t.Errorf("%s: TextAccessLog = %s, want %s", tt.name, got, tt.text)
+		}
+		if got := JSONAccessLog(tt.e); got != tt.json {
+			t.Errorf("%s: JSONAccessLog = %s, want %s", tt.name, got, tt.json)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logger := &captureLogger{}
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteStatus(201)
+		resp.WriteString("hello")
+	}), func(srv *Server) {
+		srv.Logger = logger
+		srv.AccessLogFormat = JSONAccessLog
+	})
+
+	rawRequest(t, addr, "POST /items HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var lines []string
+	for _, m := range logger.msgs {
+		if strings.HasPrefix(m, "{") {
+			lines = append(lines, m)
+		}
+	}
+	if len(lines) != 1 {
+		t.Fatalf("logged %q, want one access log line", logger.msgs)
+	}
+	var e struct {
+		RemoteAddr string `json:"remote_addr"`
+		Method     string `json:"method"`
+		RequestURI string `json:"request_uri"`
+		Proto      string `json:"proto"`
+		Status     int    `json:"status"`
+		Size       int    `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("access log line %q: %v", lines[0], err)
+	}
+	if !strings.HasPrefix(e.RemoteAddr, "127.0.0.1:") || e.Method != "POST" || e.RequestURI != "/items" ||
+		e.Proto != "HTTP/1.1" || e.Status != 201 || e.Size != 5 {
+		t.Errorf("access log line = %s", lines[0])
+	}
+}
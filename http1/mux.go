@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Handler responds to a request.
+type Handler interface {
+	ServeHTTP(resp *Response, req *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(resp *Response, req *Request)
+
+func (f HandlerFunc) ServeHTTP(resp *Response, req *Request) { f(resp, req) }
+
+// Error replies with code and msg as a plain text body.
+func Error(resp *Response, msg string, code int) {
+	resp.WriteStatus(code)
+	resp.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteData([]byte(msg + "\n"))
+}
+
+// NotFound replies with a 404 Not Found.
+func NotFound(resp *Response, req *Request) {
+	Error(resp, "404 page not found", http.StatusNotFound)
+}
+
+// StripPrefix serves requests with h after removing prefix from their path,
+// decoded and as sent, those without the prefix get a 404 Not Found.
+func StripPrefix(prefix string, h Handler) Handler {
+	return HandlerFunc(func(resp *Response, req *Request) {
+		p := strings.TrimPrefix(req.Path, prefix)
+		uri := strings.TrimPrefix(req.RequestURI, prefix)
+		if len(p) == len(req.Path) || len(uri) == len(req.RequestURI) {
+			NotFound(resp, req)
+			return
+		}
+		r2 := *req
+		r2.Path, r2.RequestURI = p, uri
+		h.ServeHTTP(resp, &r2)
+	})
+}
+
+// knownMethods are the methods the server understands, others are answered
+// with 501 Not Implemented.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// ServeMux dispatches requests to the handler registered with the pattern
+// matching the request path best.
+//
+// Like net/http, a pattern is either an exact path such as "/favicon.ico", or
+// a subtree rooted at a path ending with a slash such as "/static/", which
+// matches every path under it. Longer patterns take precedence, so "/" serves
+// whatever no other pattern matches.
+//
+// A handler serves every method of its pattern, unless it is registered for
+// a method with HandleMethod. A GET handler serves HEAD requests too, unless
+// there is one for HEAD, the body it writes being left out of the response.
+// Requests with a method there is no handler for get a 405 Method Not
+// Allowed. OPTIONS requests get the methods allowed for the path, or for the
+// server as a whole with "OPTIONS *", even from a handler of every method:
+// one registered for OPTIONS with HandleMethod answers them instead, as a
+// CORS handler has to for preflight requests unless it wraps the mux.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[string]*route
+}
+
+type route struct {
+	any     Handler            // registered with Handle
+	methods map[string]Handler // registered with HandleMethod
+}
+
+// allow returns the methods r serves on srv, for the Allow header.
+func (r *route) allow(srv *Server) string {
+	served := srv.methods()
+	if r.any != nil {
+		return allow(served)
+	}
+	methods := map[string]bool{http.MethodOptions: true}
+	for m := range r.methods {
+		if served[m] {
+			methods[m] = true
+		}
+	}
+	if _, ok := r.methods[http.MethodGet]; ok {
+		methods[http.MethodHead] = true
+	}
+	return allow(methods)
+}
+
+func allow(methods map[string]bool) string {
+	list := make([]string, 0, len(methods))
+	for m := range methods {
+		list = append(list, m)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// methodNotAllowed replies with a 405 Method Not Allowed to a method the
+// server doesn't serve at all, every other method it serves being allowed.
+func methodNotAllowed(resp *Response, method string) {
+	methods := resp.srv.methods()
+	delete(methods, method)
+	resp.WriteHeader("Allow", allow(methods))
+	Error(resp, "405 method not allowed", http.StatusMethodNotAllowed)
+}
+
+// options answers an OPTIONS request with the methods allowed.
+func options(allow string) Handler {
+	return HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("Allow", allow)
+		resp.WriteStatus(http.StatusNoContent)
+	})
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: make(map[string]*route)}
+}
+
+func (mux *ServeMux) Handle(pattern string, h Handler) {
+	mux.handle("", pattern, h)
+}
+
+func (mux *ServeMux) HandleFunc(pattern string, f func(resp *Response, req *Request)) {
+	mux.Handle(pattern, HandlerFunc(f))
+}
+
+// HandleMethod registers h for the requests of method to pattern.
+func (mux *ServeMux) HandleMethod(method, pattern string, h Handler) {
+	if !knownMethods[method] {
+		panic("unknown method " + method)
+	}
+	mux.handle(method, pattern, h)
+}
+
+func (mux *ServeMux) handle(method, pattern string, h Handler) {
+	if pattern == "" || pattern[0] != '/' {
+		panic("invalid pattern " + pattern)
+	}
+	if h == nil {
+		panic("nil handler for " + pattern)
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	rt, ok := mux.m[pattern]
+	if !ok {
+		rt = &route{methods: make(map[string]Handler)}
+		mux.m[pattern] = rt
+	}
+	if method == "" {
+		if rt.any != nil {
+			panic("multiple registrations for " + pattern)
+		}
+		rt.any = h
+		return
+	}
+	if _, ok := rt.methods[method]; ok {
+		panic("multiple registrations for " + method + " " + pattern)
+	}
+	rt.methods[method] = h
+}
+
+// Handler returns the handler to serve req with, NotFound if no pattern
+// matches.
+func (mux *ServeMux) Handler(req *Request) Handler {
+	if !knownMethods[req.Method] {
+		return HandlerFunc(func(resp *Response, req *Request) {
+			Error(resp, "501 not implemented", http.StatusNotImplemented)
+		})
+	}
+
+	if req.Method == http.MethodOptions && req.RequestURI == "*" {
+		return options(allow(req.srv.methods()))
+	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	rt := mux.match(req.Path)
+	if rt == nil {
+		return HandlerFunc(NotFound)
+	}
+	if h, ok := rt.methods[req.Method]; ok {
+		return h
+	}
+	if h, ok := rt.methods[http.MethodGet]; ok && req.Method == http.MethodHead {
+		return h
+	}
+	allow := rt.allow(req.srv)
+	if req.Method == http.MethodOptions {
+		return options(allow)
+	}
+	if rt.any != nil {
+		return rt.any
+	}
+	return HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("Allow", allow)
+		Error(resp, "405 method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// match returns the route of the pattern matching path best, nil if none.
+func (mux *ServeMux) match(path string) *route {
+	if rt, ok := mux.m[path]; ok {
+		return rt
+	}
+
+	var rt *route
+	longest := 0
+	for pattern, prt := range mux.m {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > longest {
+			rt, longest = prt, len(pattern)
+		}
+	}
+	return rt
+}
+
+func (mux *ServeMux) ServeHTTP(resp *Response, req *Request) {
+	mux.Handler(req).ServeHTTP(resp, req)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serveMux serves a request of method to target with mux, returning the
+// response buffered.
+func serveMux(mux *ServeMux, method, target string) *Response {
+	req := &Request{Method: method, RequestURI: target, Path: target, Header: make(http.Header)}
+	if target == "*" {
+		req.Path = ""
+	}
+	resp := &Response{req: req}
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestServeMuxMethods(t *testing.T) {
+	reply := func(name string) Handler {
+		return HandlerFunc(func(resp *Response, req *Request) { resp.WriteString(name) })
+	}
+	mux := NewServeMux()
+	mux.HandleMethod(http.MethodGet, "/items", reply("get"))
+	mux.HandleMethod(http.MethodPost, "/items", reply("post"))
+	mux.Handle("/any", reply("any"))
+	mux.HandleMethod(http.MethodDelete, "/any", reply("delete"))
+
+	tests := []struct {
+		method, target string
+		status         int
+		body, allow    string
+	}{
+		{http.MethodGet, "/items", 0, "get", ""},
+		{http.MethodPost, "/items", 0, "post", ""},
+		{http.MethodPut, "/items", http.StatusMethodNotAllowed, "405 method not allowed\n", "GET, HEAD, OPTIONS, POST"},
+		{http.MethodPatch, "/any", 0, "any", ""},
+		{http.MethodDelete, "/any", 0, "delete", ""},
+		{"BREW", "/items", http.StatusNotImplemented, "501 not implemented\n", ""},
+		{http.MethodGet, "/missing", http.StatusNotFound, "404 page not found\n", ""},
+	}
+	for _, tt := range tests {
+		resp := serveMux(mux, tt.method, tt.target)
+		if resp.status != tt.status || string(resp.data) != tt.body {
+			t.Errorf("%s %s: %d %q, want %d %q", tt.method, tt.target, resp.status, resp.data, tt.status, tt.body)
+		}
+		if got := resp.header.Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tt.method, tt.target, got, tt.allow)
+		}
+	}
+
+	if !panics(func() { mux.HandleMethod("BREW", "/coffee", reply("coffee")) }) {
+		t.Error("HandleMethod of an unknown method didn't panic")
+	}
+	if !panics(func() { mux.HandleMethod(http.MethodGet, "/items", reply("again")) }) {
+		t.Error("second GET registration of /items didn't panic")
+	}
+}
+
+func TestServeMuxOptions(t *testing.T) {
+	ok := HandlerFunc(func(resp *Response, req *Request) { resp.WriteString("ok") })
+	mux := NewServeMux()
+	mux.HandleMethod(http.MethodGet, "/items", ok)
+	mux.HandleMethod(http.MethodPost, "/items", ok)
+	mux.Handle("/any", ok)
+	mux.HandleMethod(http.MethodOptions, "/cors", HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("Access-Control-Allow-Origin", "*")
+	}))
+
+	// CONNECT and TRACE aren't served by default
+	all := "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT"
+	tests := []struct {
+		name, target, allow string
+	}{
+		{"registered per method", "/items", "GET, HEAD, OPTIONS, POST"},
+		{"registered for every method", "/any", all},
+		{"asterisk", "*", all},
+	}
+	for _, tt := range tests {
+		resp := serveMux(mux, http.MethodOptions, tt.target)
+		if resp.status != http.StatusNoContent {
+			t.Errorf("%s: status = %d, want 204", tt.name, resp.status)
+		}
+		if got := resp.header.Get("Allow"); got != tt.allow {
+			t.Errorf("%s: Allow = %q, want %q", tt.name, got, tt.allow)
+		}
+		if len(resp.data) > 0 {
+			t.Errorf("%s: body %q", tt.name, resp.data)
+		}
+	}
+
+	resp := serveMux(mux, http.MethodOptions, "/cors")
+	if resp.header.Get("Access-Control-Allow-Origin") != "*" || resp.header.Get("Allow") != "" {
+		t.Errorf("OPTIONS handler not used: %v", resp.header)
+	}
+	resp = serveMux(mux, http.MethodDelete, "/items")
+	if resp.status != http.StatusMethodNotAllowed || resp.header.Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("DELETE: %d with Allow %q, want a 405 with the methods allowed", resp.status, resp.header.Get("Allow"))
+	}
+}
+
+func TestServeMuxOptionsAsterisk(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  func(*Server)
+		allow string
+	}{
+		{"default", nil, "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT"},
+		{"proxy and trace enabled", func(srv *Server) { srv.Proxy, srv.Trace = true, true },
+			"CONNECT, DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT, TRACE"},
+	}
+	for _, tt := range tests {
+		addr := startServer(t, NewServeMux(), tt.conf)
+		resp := rawRequest(t, addr, "OPTIONS * HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body := splitResponse(resp)
+		if statusLine(resp) != "HTTP/1.1 204 No Content" || body != "" {
+			t.Errorf("%s: OPTIONS * = %q, want a 204 without a body", tt.name, resp)
+		}
+		if !strings.Contains(head, "\r\nAllow: "+tt.allow+"\r\n") {
+			t.Errorf("%s: no Allow of %s:\n%s", tt.name, tt.allow, head)
+		}
+	}
+}
+
+func TestServeMuxHead(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleMethod(http.MethodGet, "/page", HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("X-Method", req.Method)
+		resp.WriteString("hello")
+	}))
+	mux.HandleMethod(http.MethodGet, "/own", HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString("get")
+	}))
+	mux.HandleMethod(http.MethodHead, "/own", HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("X-Handler", "head")
+	}))
+	addr := startServer(t, mux, nil)
+
+	resp := rawRequest(t, addr, "HEAD /page HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, body := splitResponse(resp)
+	if statusLine(resp) != "HTTP/1.1 200 OK" || !strings.Contains(head, "\r\nX-Method: HEAD\r\n") {
+		t.Errorf("HEAD not served by the GET handler:\n%s", resp)
+	}
+	if !strings.Contains(head, "\r\nContent-Length: 5\r\n") || body != "" {
+		t.Errorf("HEAD: want the Content-Length of the GET body without the body:\n%s", resp)
+	}
+
+	resp = rawRequest(t, addr, "HEAD /own HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(resp, "\r\nX-Handler: head\r\n") {
+		t.Errorf("HEAD handler not used:\n%s", resp)
+	}
+
+	if r := serveMux(mux, http.MethodPost, "/page"); r.status != http.StatusMethodNotAllowed {
+		t.Errorf("POST to a GET route: status = %d, want 405", r.status)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitOptions configures the requests RateLimit lets through.
+type RateLimitOptions struct {
+	Rate           float64  // requests per second a client is allowed on average
+	Burst          int      // requests a client can send at once, 1 when less
+	TrustedProxies []string // telling the address of the client, as for ClientIP
+}
+
+// rateLimitSweep is the interval buckets left full are removed at.
+const rateLimitSweep = time.Minute
+
+// RateLimit serves the requests of each client with h up to a rate, replying
+// with a 429 Too Many Requests to those over it, along with a Retry-After
+// header telling when to retry.
+//
+// Each client IP has a token bucket of Burst tokens, refilled at Rate tokens
+// per second, a request taking one. Buckets idle long enough to be full
+// again are no different from new ones, they are removed as requests come so
+// that the clients gone don't take up memory.
+func RateLimit(h Handler, opts RateLimitOptions) Handler {
+	burst := float64(opts.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimiter{rate: opts.Rate, burst: burst, buckets: make(map[string]*bucket)}
+
+	return HandlerFunc(func(resp *Response, req *Request) {
+		wait := l.take(req.ClientIP(opts.TrustedProxies...), time.Now())
+		if wait > 0 {
+			resp.WriteHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			Error(resp, "429 too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+type rateLimiter struct {
+	rate, burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket // by client IP
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // tokens were counted at
+}
+
+// take takes a token of the bucket of client at now, returning zero, or the
+// time to wait for one if the bucket is empty.
+func (l *rateLimiter) take(client string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweep {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if l.rate <= 0 {
+		return rateLimitSweep // never refilled, the client is to retry much later
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that are full again at now.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	ok := HandlerFunc(func(resp *Response, req *Request) { resp.WriteString("ok") })
+	h := RateLimit(ok, RateLimitOptions{Rate: 0.5, Burst: 3})
+	serve := func(remoteAddr string) *Response {
+		req := &Request{Method: "GET", RemoteAddr: remoteAddr, Header: make(http.Header)}
+		resp := &Response{req: req}
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := serve("192.0.2.1:1000"); resp.status != 0 || string(resp.data) != "ok" {
+			t.Fatalf("request %d within the burst: status %d", i+1, resp.status)
+		}
+	}
+	resp := serve("192.0.2.1:2000") // another connection of the same client
+	if resp.status != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want 429", resp.status)
+	}
+	if got := resp.header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if resp := serve("192.0.2.2:1000"); resp.status != 0 {
+		t.Errorf("another client: status %d, want it served", resp.status)
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l := &rateLimiter{rate: 2, burst: 1, buckets: make(map[string]*bucket)}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if wait := l.take("a", now); wait != 0 {
+		t.Fatalf("first request: wait %v", wait)
+	}
+	if wait := l.take("a", now); wait != 500*time.Millisecond {
+		t.Errorf("empty bucket: wait %v, want 500ms", wait)
+	}
+	if wait := l.take("a", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Errorf("refilled bucket: wait %v", wait)
+	}
+
+	// the bucket full again is removed by the next sweep
+	l.take("b", now.Add(rateLimitSweep))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket not swept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("bucket in use swept")
+	}
+
+	l = &rateLimiter{rate: 0, burst: 1, buckets: make(map[string]*bucket)}
+	l.take("a", now)
+	if wait := l.take("a", now.Add(time.Hour)); wait != rateLimitSweep {
+		t.Errorf("never refilled: wait %v, want %v", wait, rateLimitSweep)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLen bounds the length of the request IDs taken from clients.
+const maxRequestIDLen = 128
+
+// RequestID tags each request with an ID, for its logs to be traced across
+// the services it goes through. The ID comes from the X-Request-Id header
+// of the request, or is generated when missing or unfit: longer than 128
+// bytes or not a token. It is echoed in the X-Request-Id header of the
+// response and written in the access log.
+//
+// RequestID is to be the outermost middleware, as it tags the request
+// itself rather than a copy, the access log reading it back.
+func RequestID(h Handler) Handler {
+	return HandlerFunc(func(resp *Response, req *Request) {
+		id := req.Header.Get("X-Request-Id")
+		if len(id) > maxRequestIDLen || !isToken(id) {
+			id = newRequestID()
+		}
+		req.ctx = context.WithValue(req.Context(), requestIDKey{}, id)
+		resp.WriteHeader("X-Request-Id", id)
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// newRequestID returns 16 random bytes in hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate request ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestIDFromContext returns the ID the RequestID middleware tagged the
+// request of ctx with, empty if none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
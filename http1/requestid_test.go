@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	logger := &captureLogger{}
+	addr := startServer(t, RequestID(HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(RequestIDFromContext(req.Context()))
+	})), func(srv *Server) {
+		srv.Logger = logger
+		srv.AccessLogFormat = TextAccessLog
+	})
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	tests := []struct {
+		name, header, want string // want empty for a generated ID
+	}{
+		{"incoming", "X-Request-Id: abc-123\r\n", "abc-123"},
+		{"missing", "", ""},
+		{"not a token", "X-Request-Id: a b\r\n", ""},
+		{"too long", "X-Request-Id: " + strings.Repeat("a", 129) + "\r\n", ""},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+tt.header+"\r\n")
+		head, id := splitResponse(resp)
+		if tt.want != "" && id != tt.want {
+			t.Errorf("%s: handler got ID %q, want %q", tt.name, id, tt.want)
+		}
+		if tt.want == "" && !generated.MatchString(id) {
+			t.Errorf("%s: handler got ID %q, want a generated one", tt.name, id)
+		}
+		if !strings.Contains(head, "\r\nX-Request-Id: "+id+"\r\n") {
+			t.Errorf("%s: ID %q not echoed:\n%s", tt.name, id, head)
+		}
+		logged := false
+		logger.mu.Lock()
+		for _, m := range logger.msgs {
+			logged = logged || strings.HasSuffix(m, " "+id)
+		}
+		logger.mu.Unlock()
+		if !logged {
+			t.Errorf("%s: ID %q not in the access log", tt.name, id)
+		}
+	}
+
+	if a, b := newRequestID(), newRequestID(); a == b {
+		t.Errorf("generated the same ID twice: %s", a)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server serves HTTP/1.x requests with Handler. Its configuration is not to
+// be changed once serving. A zero limit or timeout means none.
+type Server struct {
+	// Addr is the address to listen on, a TCP address or "unix:" followed by
+	// the path of a Unix socket.
+	Addr    string
+	Handler Handler
+
+	// TLSConfig, when set, serves HTTPS.
+	TLSConfig *tls.Config
+
+	// ReadTimeout bounds the time to read a request line and its headers, a
+	// client not done by then gets a 408 Request Timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds the time to write the response to a request,
+	// counted from the end of its header, handler and streamed body
+	// included. A client not reading it by then has its connection closed.
+	WriteTimeout time.Duration
+
+	// IdleTimeout bounds the time to wait for the next request on a
+	// kept-alive connection, then closed. Zero means ReadTimeout applies.
+	IdleTimeout time.Duration
+
+	// ShutdownTimeout bounds the time to wait for in-flight connections once
+	// the server is asked to stop.
+	ShutdownTimeout time.Duration
+
+	// MaxConns bounds the number of connections served at once, the
+	// connections over it are answered with 503 Service Unavailable.
+	MaxConns int
+
+	// MaxRequestsPerConn bounds the number of requests served on a
+	// connection, the last one is answered with Connection: close.
+	MaxRequestsPerConn int
+
+	// MaxRequestLineBytes bounds the size of the request line, most of it
+	// being the request URI, a longer line is answered with 414 URI Too Long.
+	MaxRequestLineBytes int
+
+	// MaxHeaderBytes bounds the total size of the head of a request, the
+	// request line and the header lines read out of a single budget, a
+	// larger head is answered with 431 Request Header Fields Too Large. It
+	// bounds the trailer section of a chunked body as well.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes bounds the size of a request body, counted after decoding
+	// its transfer codings.
+	MaxBodyBytes int64
+
+	// StrictCRLF rejects requests whose request line or header lines end with
+	// a bare LF, tolerated otherwise as RFC 7230 section 3.5 allows.
+	StrictCRLF bool
+
+	// ServerName is sent in the Server header of responses whose handler
+	// didn't set one. Empty means no Server header.
+	ServerName string
+
+	// DefaultHeaders are added to every response, such as security headers
+	// like "X-Content-Type-Options: nosniff". A header the handler set, to
+	// one value or more, is left as is. The keys are in canonical form.
+	DefaultHeaders http.Header
+
+	// Compress enables compressing response bodies of at least
+	// CompressMinBytes for clients accepting the gzip or deflate content
+	// coding.
+	Compress         bool
+	CompressMinBytes int
+
+	// H2C enables switching to HTTP/2 on the client's request, see h2c.go.
+	H2C bool
+
+	// Proxy enables tunneling CONNECT requests to the host they name, as a
+	// forward proxy does, see connect.go. Any client can then reach any host
+	// the server can. They get a 405 Method Not Allowed otherwise, whatever
+	// the handler.
+	Proxy bool
+
+	// Trace enables answering TRACE requests with the request received, see
+	// trace.go. They get a 405 Method Not Allowed otherwise, whatever the
+	// handler.
+	Trace bool
+
+	// SortHeaders writes the header fields of responses sorted by name,
+	// rather than in the random order Go ranges over maps in, for the output
+	// to be the same from one run to the next.
+	SortHeaders bool
+
+	// ErrorHandler writes the responses of the errors the server answers by
+	// itself, such as a 400 Bad Request for a malformed request, a 408
+	// Request Timeout or a 500 Internal Server Error for a handler that
+	// panicked. req is nil when the request couldn't be read. Nil means
+	// TextErrorHandler. The connection is closed after the response.
+	ErrorHandler func(resp *Response, req *Request, code int, err error)
+
+	// AccessLogFormat formats the access log line of each request served,
+	// nil disables the access log.
+	AccessLogFormat func(AccessEntry) string
+
+	// Logger receives the messages of the server and its access log, nil
+	// meaning the standard logger of the log package.
+	Logger Logger
+
+	metrics Metrics
+
+	mu       sync.Mutex
+	listener net.Listener
+	closing  bool
+	idle     map[net.Conn]struct{} // waiting for their next request
+}
+
+// Logger is where a server writes its messages, as a *log.Logger does.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+func (srv *Server) logger() Logger {
+	if srv == nil || srv.Logger == nil {
+		return log.Default()
+	}
+	return srv.Logger
+}
+
+// NewServer returns a server of handler on addr with the default
+// configuration.
+func NewServer(addr string, handler Handler) *Server {
+	return &Server{
+		Addr:                addr,
+		Handler:             handler,
+		ReadTimeout:         10 * time.Second,
+		WriteTimeout:        30 * time.Second,
+		IdleTimeout:         60 * time.Second,
+		ShutdownTimeout:     5 * time.Second,
+		MaxConns:            1024,
+		MaxRequestLineBytes: 8 << 10,
+		MaxHeaderBytes:      1 << 20,
+		MaxBodyBytes:        10 << 20,
+		ServerName:          "http-explained/0.1",
+		Compress:            true,
+		CompressMinBytes:    1024,
+		H2C:                 true,
+		AccessLogFormat:     TextAccessLog,
+	}
+}
+
+// Metrics returns the counters of the server, also a handler rendering them.
+func (srv *Server) Metrics() *Metrics { return &srv.metrics }
+
+// ListenAndServe listens on srv.Addr and serves the connections accepted
+// until Shutdown.
+func (srv *Server) ListenAndServe() error {
+	l, err := listen(srv.Addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", srv.Addr, err)
+	}
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+	return srv.Serve(l)
+}
+
+// listen listens on addr, a TCP address or "unix:" followed by the path of a
+// Unix socket. The socket file is removed when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// left behind by a server that didn't shut down, unless one still
+		// listens on it
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// maxAcceptDelay bounds the backoff after temporary errors accepting
+// connections, as running out of file descriptors.
+const maxAcceptDelay = time.Second
+
+// Serve serves the connections accepted from l until Shutdown, then waits for
+// those being served up to ShutdownTimeout. Temporary errors accepting
+// connections are retried after a backoff, others stop serving, returned
+// once the connections are done with.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		l.Close()
+		return errors.New("server is shut down")
+	}
+	srv.listener = l
+	srv.mu.Unlock()
+
+	var conns sync.WaitGroup
+	var slots chan struct{} // taken by each connection served
+	if srv.MaxConns > 0 {
+		slots = make(chan struct{}, srv.MaxConns)
+	}
+	srv.infoLog("starting server, listen on " + l.Addr().String())
+	var acceptErr error
+	var delay time.Duration // backoff after a temporary accept error
+	for {
+		srv.infoLog("start listening...")
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				if delay *= 2; delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				srv.errorLog("accept connection", fmt.Errorf("%w, retrying in %v", err, delay))
+				time.Sleep(delay)
+				continue
+			}
+			srv.errorLog("accept connection", err)
+			acceptErr = fmt.Errorf("accept connection: %w", err)
+			break
+		}
+		delay = 0
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				go srv.refuseConn(conn)
+				continue
+			}
+		}
+
+		atomic.AddInt64(&srv.metrics.ConnsAccepted, 1)
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			srv.handleConn(conn)
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	var timeout <-chan time.Time // never fires without a ShutdownTimeout
+	if srv.ShutdownTimeout > 0 {
+		timeout = time.After(srv.ShutdownTimeout)
+	}
+	select {
+	case <-drained:
+		srv.infoLog("all connections are closed, served " + srv.metrics.String())
+	case <-timeout:
+		srv.errorLog("wait for connections", errors.New("shutdown timeout"))
+	}
+	return acceptErr
+}
+
+// Shutdown stops the server from accepting connections, Serve returning once
+// the connections being served are done with. The connections waiting for
+// their next request are closed right away, the others once the response in
+// flight is sent, with Connection: close.
+func (srv *Server) Shutdown() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closing = true
+	for conn := range srv.idle {
+		// the wait for the next request times out, ending the connection
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	if srv.listener == nil {
+		return nil
+	}
+	// the accept loop ends with net.ErrClosed
+	return srv.listener.Close()
+}
+
+// shuttingDown reports whether Shutdown has been called.
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// setIdle records whether conn is waiting for its next request, for Shutdown
+// to end the wait. The read deadline of conn is to be set beforehand. It
+// reports false when shutting down, conn not to wait at all.
+func (srv *Server) setIdle(conn net.Conn, idle bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !idle {
+		delete(srv.idle, conn)
+		return true
+	}
+	if srv.closing {
+		return false
+	}
+	if srv.idle == nil {
+		srv.idle = make(map[net.Conn]struct{})
+	}
+	srv.idle[conn] = struct{}{}
+	return true
+}
+
+var errTooManyConns = errors.New("too many connections")
+
+// refuseConn answers a connection over MaxConns with a 503 Service
+// Unavailable, not waiting long for the client to take it.
+func (srv *Server) refuseConn(conn net.Conn) {
+	defer closeConn(conn)
+	srv.errorLog("accept connection", fmt.Errorf("%w: more than %d", errTooManyConns, srv.MaxConns))
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		srv.errorLog("set write deadline", err)
+		return
+	}
+	srv.writeError(bufio.NewWriter(conn), nil, http.StatusServiceUnavailable, errTooManyConns)
+}
+
+// closeConn closes conn, first letting the client read the response: closing
+// with unread data resets the connection, the client possibly dropping the
+// response before reading it.
+func closeConn(conn net.Conn) {
+	defer conn.Close()
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return
+	}
+	// wait for the client to close its side, discarding what it sends
+	if err := conn.SetReadDeadline(time.Now().Add(lingerTimeout)); err != nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, conn)
+}
+
+// connReader reads the connection for its bufio.Reader. While the handler of
+// a request without a body runs, nothing is to be read until the next
+// request: the connection is read in the background then, to tell when the
+// client goes away.
+type connReader struct {
+	conn    net.Conn
+	byteBuf [1]byte
+	hasByte bool          // byteBuf holds the first byte of the next request
+	done    chan struct{} // closed once the background read returned
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if cr.hasByte && len(p) > 0 {
+		p[0], cr.hasByte = cr.byteBuf[0], false
+		return 1, nil
+	}
+	return cr.conn.Read(p)
+}
+
+// startBackgroundRead reads the connection in the background until
+// stopBackgroundRead, calling gone if the client closes it meanwhile.
+func (cr *connReader) startBackgroundRead(gone func()) {
+	done := make(chan struct{})
+	cr.done = done
+	go func() {
+		defer close(done)
+		n, err := cr.conn.Read(cr.byteBuf[:])
+		switch {
+		case n == 1:
+			cr.hasByte = true // pipelined, kept for the next read
+		case !isTimeout(err):
+			gone()
+		}
+	}()
+}
+
+// stopBackgroundRead stops the background read by the read deadline and
+// waits for it to return, the connection then being readable again.
+func (cr *connReader) stopBackgroundRead() {
+	if cr.done == nil {
+		return
+	}
+	_ = cr.conn.SetReadDeadline(time.Unix(1, 0)) // long gone
+	<-cr.done
+	cr.done = nil
+	_ = cr.conn.SetReadDeadline(time.Time{})
+}
+
+func (srv *Server) handleConn(conn net.Conn) {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			closeConn(conn)
+		}
+	}()
+	srv.infoLog("start processing connection")
+
+	// canceled once the connection is done with, whatever the reason, the
+	// client closing it included
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cr := &connReader{conn: conn}
+	r, w := bufio.NewReader(cr), bufio.NewWriter(countingConn{conn, &srv.metrics})
+	rw := bufio.NewReadWriter(r, w)
+	for n := 0; ; n++ {
+		req, err := srv.readRequest(conn, r, w, n > 0)
+		if srv.WriteTimeout > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(srv.WriteTimeout)); err != nil {
+				srv.errorLog("set write deadline", err)
+				break
+			}
+		}
+		if err != nil {
+			var se statusError
+			if errors.As(err, &se) {
+				srv.errorLog("read request", err)
+				srv.writeError(w, nil, se.code, se.err)
+			} else if err != io.EOF {
+				srv.errorLog("read request", err)
+			}
+			break
+		}
+
+		req.ctx = ctx
+		if settings, ok := srv.h2cUpgrade(req); ok {
+			// the connection switches to HTTP/2 for this last request
+			if err := srv.serveH2C(conn, r, w, req, settings); err != nil {
+				srv.errorLog("serve h2c", err)
+			}
+			break
+		}
+
+		start := time.Now()
+		keepAlive := shouldKeepAlive(req) && (srv.MaxRequestsPerConn <= 0 || n+1 < srv.MaxRequestsPerConn) && !srv.shuttingDown()
+
+		resp := Response{w: w, req: req, srv: srv, conn: conn, rw: rw, cr: cr}
+		if keepAlive {
+			resp.WriteHeader("Connection", "keep-alive")
+		} else {
+			resp.WriteHeader("Connection", "close")
+		}
+		if req.body.empty() && r.Buffered() == 0 {
+			cr.startBackgroundRead(cancel)
+		}
+		served := srv.serve(&resp, req)
+		cr.stopBackgroundRead()
+		if resp.hijacked {
+			// the connection is the handler's now
+			hijacked = true
+			srv.infoLog("connection hijacked")
+			return
+		}
+		if !served {
+			// a response whose head is sent is left unterminated, or short of
+			// its length, so the client can tell it is incomplete
+			if !resp.headSent() {
+				srv.writeError(w, req, http.StatusInternalServerError, errPanicked)
+			}
+			break
+		}
+		if req.body.tooLarge {
+			if !resp.headSent() {
+				srv.writeError(w, req, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			}
+			break
+		}
+
+		if req.body.expect != nil || req.body.closed && !req.body.eof || srv.shuttingDown() {
+			// the client still holds back the body the handler didn't ask
+			// for, the connection can't be reused without knowing whether
+			// it is going to be sent, nor once the handler closed a body
+			// too long to discard, nor once the server is shutting down
+			keepAlive = false
+			resp.header["Connection"] = []string{"close"}
+		}
+		if headerHasToken(resp.header, "Connection", "close") {
+			// as the handler asked, in place of the keep-alive set beforehand
+			keepAlive = false
+			resp.header["Connection"] = []string{"close"}
+		}
+
+		if err := resp.finish(); err != nil {
+			srv.errorLog("write response", err)
+			break
+		}
+		srv.accessLog(req, &resp, start)
+		if !keepAlive {
+			break
+		}
+
+		// pipelined requests wait in r, the unread body is discarded for the
+		// next request line to be read, unless it is cheaper to close
+		if err := req.body.drain(); err != nil {
+			if err != errBodyLeft {
+				srv.errorLog("drain request body", err)
+			}
+			break
+		}
+	}
+	srv.infoLog("end of connection")
+}
+
+var errPanicked = errors.New("handler panicked")
+
+// serve runs the handler, recovering from its panic, then removes the files
+// of the multipart forms parsed from the body, by copies of req as well. It
+// reports whether the handler returned normally.
+func (srv *Server) serve(resp *Response, req *Request) (ok bool) {
+	atomic.AddInt64(&srv.metrics.RequestsInFlight, 1)
+	defer func() {
+		if err := recover(); err != nil {
+			srv.errorLog("serve "+req.RequestURI, fmt.Errorf("panic: %v\n%s", err, debug.Stack()))
+		}
+		atomic.AddInt64(&srv.metrics.RequestsInFlight, -1)
+		atomic.AddInt64(&srv.metrics.RequestsServed, 1)
+		for _, form := range req.body.forms {
+			if err := form.RemoveAll(); err != nil {
+				srv.errorLog("remove multipart files", err)
+			}
+		}
+	}()
+	switch req.Method {
+	case http.MethodConnect:
+		srv.connect(resp, req)
+		return true
+	case http.MethodTrace:
+		srv.trace(resp, req)
+		return true
+	}
+	srv.Handler.ServeHTTP(resp, req)
+	return true
+}
+
+// methods returns the methods srv serves, CONNECT and TRACE only when
+// enabled. A nil srv, as of a request not read by a server, has the
+// defaults.
+func (srv *Server) methods() map[string]bool {
+	methods := make(map[string]bool, len(knownMethods))
+	for m := range knownMethods {
+		methods[m] = true
+	}
+	if srv == nil || !srv.Proxy {
+		delete(methods, http.MethodConnect)
+	}
+	if srv == nil || !srv.Trace {
+		delete(methods, http.MethodTrace)
+	}
+	return methods
+}
+
+// writeError responds to req, nil if it couldn't be read, with a code
+// response closing the connection, written by the ErrorHandler of the
+// server. The response is left bodyless if ErrorHandler panics.
+func (srv *Server) writeError(w *bufio.Writer, req *Request, code int, err error) {
+	resp := Response{w: w, req: req, srv: srv}
+	resp.WriteStatus(code)
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				srv.errorLog("handle error", fmt.Errorf("panic: %v\n%s", p, debug.Stack()))
+				resp = Response{w: w, req: req, srv: srv, status: code}
+			}
+		}()
+		errorHandler := srv.ErrorHandler
+		if errorHandler == nil {
+			errorHandler = TextErrorHandler
+		}
+		errorHandler(&resp, req, code, err)
+	}()
+	delete(resp.header, "Connection")
+	resp.WriteHeader("Connection", "close")
+	if err := resp.finish(); err != nil {
+		srv.errorLog("write error response", err)
+	}
+}
+
+// TextErrorHandler is the default ErrorHandler, replying with the status and
+// its reason phrase as a plain text body, such as "400 bad request". err
+// isn't given away to the client.
+func TextErrorHandler(resp *Response, req *Request, code int, err error) {
+	Error(resp, strconv.Itoa(code)+" "+strings.ToLower(reasonPhrase(code)), code)
+}
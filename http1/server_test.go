@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves h on an ephemeral port of the loopback interface and
+// returns its address. conf, if not nil, changes the default configuration
+// beforehand. The server is shut down at the end of the test.
+func startServer(t *testing.T, h Handler, conf func(*Server)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(l.Addr().String(), h)
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	srv.AccessLogFormat = nil
+	if conf != nil {
+		conf(srv)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Shutdown()
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Errorf("Serve: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Serve didn't return after Shutdown")
+		}
+	})
+	return l.Addr().String()
+}
+
+// rawRequest sends req as is on a connection of its own to addr and returns
+// everything the server sent back until it closed the connection.
+func rawRequest(t *testing.T, addr, req string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read the response to %q: %v", req, err)
+	}
+	return string(resp)
+}
+
+// statusLine returns the status line a raw response begins with.
+func statusLine(resp string) string {
+	line, _, _ := strings.Cut(resp, "\r\n")
+	return line
+}
+
+// splitResponse splits a raw response into its head, the status line and
+// header lines, and its body.
+func splitResponse(resp string) (head, body string) {
+	head, body, _ = strings.Cut(resp, "\r\n\r\n")
+	return head + "\r\n", body
+}
+
+func TestServe(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteHeader("Content-Type", "text/plain")
+		resp.WriteString("hello " + req.Path)
+	}), nil)
+
+	resp, err := http.Get("http://" + addr + "/world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello /world" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "hello /world")
+	}
+	if got := resp.Header.Get("Server"); got != "http-explained/0.1" {
+		t.Errorf("Server = %q, want the default name", got)
+	}
+}
+
+func TestServeKeepAlive(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Path)
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if n := strings.Count(resp, "HTTP/1.1 200 OK\r\n"); n != 2 {
+		t.Fatalf("got %d responses, want 2:\n%s", n, resp)
+	}
+	if !strings.HasSuffix(resp, "/b") || !strings.Contains(resp, "\r\n\r\n/aHTTP/1.1") {
+		t.Errorf("responses out of order:\n%s", resp)
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	srv := NewServer("", nil)
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	srv.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(l); err == nil {
+		t.Error("Serve after Shutdown returned no error")
+	}
+}
+
+func TestShutdownWaitsForInFlight(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		started, release := make(chan struct{}), make(chan struct{})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := NewServer("", HandlerFunc(func(resp *Response, req *Request) {
+			close(started)
+			<-release
+			resp.WriteString("done")
+		}))
+		srv.Logger = log.New(ioutil.Discard, "", 0)
+		srv.AccessLogFormat = nil
+		srv.ShutdownTimeout = timeout
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(l) }()
+
+		got := make(chan string, 1)
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				got <- err.Error()
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+			b, _ := ioutil.ReadAll(conn)
+			got <- string(b)
+		}()
+		<-started
+		srv.Shutdown()
+		select {
+		case <-served:
+			t.Fatalf("ShutdownTimeout %v: Serve returned before the request in flight was served", timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		resp := <-got
+		if statusLine(resp) != "HTTP/1.1 200 OK" || !strings.Contains(resp, "Connection: close\r\n") || !strings.HasSuffix(resp, "done") {
+			t.Errorf("ShutdownTimeout %v: response in flight = %q", timeout, resp)
+		}
+	}
+}
+
+func TestShutdownKeepAlive(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	var srv *Server
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/wait" {
+			started <- struct{}{}
+			<-release
+		}
+		resp.WriteString(req.Path)
+	}), func(s *Server) { srv = s })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// the first response keeps the connection alive, the second is in flight
+	// when shutting down, along with a pipelined third never served
+	conn.Write([]byte("GET /first HTTP/1.1\r\nHost: x\r\n\r\n"))
+	first, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(first.Body)
+	if first.Close {
+		t.Fatal("the first response closed the connection")
+	}
+	conn.Write([]byte("GET /wait HTTP/1.1\r\nHost: x\r\n\r\nGET /third HTTP/1.1\r\nHost: x\r\n\r\n"))
+	<-started
+	srv.Shutdown()
+	close(release)
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("connection not closed after the response in flight: %v", err)
+	}
+	head, body := splitResponse(string(rest))
+	if statusLine(string(rest)) != "HTTP/1.1 200 OK" || body != "/wait" {
+		t.Fatalf("response in flight = %q", rest)
+	}
+	if !strings.Contains(head, "\r\nConnection: close\r\n") {
+		t.Errorf("no Connection: close:\n%s", head)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	var srv *Server
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Path)
+	}), func(s *Server) { srv = s })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+
+	// waiting for its next request, the connection is closed right away
+	srv.Shutdown()
+	if b, err := ioutil.ReadAll(r); err != nil || len(b) > 0 {
+		t.Errorf("idle connection after Shutdown: read %q, %v, want it closed", b, err)
+	}
+}
+
+func TestKeepAliveByVersion(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Path)
+	}), nil)
+
+	tests := []struct {
+		proto, connection string
+		keepAlive         bool
+	}{
+		{"HTTP/1.1", "", true},
+		{"HTTP/1.1", "close", false},
+		{"HTTP/1.0", "", false},
+		{"HTTP/1.0", "keep-alive", true},
+	}
+	for _, tt := range tests {
+		req := "GET /first " + tt.proto + "\r\nHost: x\r\n"
+		if tt.connection != "" {
+			req += "Connection: " + tt.connection + "\r\n"
+		}
+		// the second request is only served on a kept-alive connection
+		resp := rawRequest(t, addr, req+"\r\nGET /second HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		want := "close"
+		if tt.keepAlive {
+			want = "keep-alive"
+		}
+		first := strings.SplitAfter(resp, "/first")[0]
+		if !strings.Contains(first, "\r\nConnection: "+want+"\r\n") {
+			t.Errorf("%s Connection %q: want Connection: %s:\n%s", tt.proto, tt.connection, want, first)
+		}
+		if got := strings.Contains(resp, "/second"); got != tt.keepAlive {
+			t.Errorf("%s Connection %q: second request served %v, want %v", tt.proto, tt.connection, got, tt.keepAlive)
+		}
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		if req.Path == "/close" {
+			resp.WriteHeader("Connection", "close")
+		}
+		resp.WriteString(req.Path)
+	}), nil)
+
+	tests := []struct {
+		name, path, connection string
+	}{
+		{"asked by the client", "/", "close"},
+		{"among other tokens", "/", "Keep-Alive, CLOSE"},
+		{"asked by the handler", "/close", "keep-alive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the second request is never read
+			resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: "+tt.connection+"\r\n\r\n"+
+				"GET /second HTTP/1.1\r\nHost: x\r\n\r\n")
+			head, body := splitResponse(resp)
+			if n := strings.Count(resp, "HTTP/1.1 "); n != 1 || body != tt.path {
+				t.Fatalf("got %d responses, want 1 of %s:\n%s", n, tt.path, resp)
+			}
+			if n := strings.Count(head, "\r\nConnection: "); n != 1 || !strings.Contains(head, "\r\nConnection: close\r\n") {
+				t.Errorf("want a single Connection: close:\n%s", head)
+			}
+		})
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		// the bodies are left unread
+		resp.WriteString(req.Method + " " + req.Path + ";")
+	}), nil)
+
+	resp := rawRequest(t, addr, "GET /1 HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"POST /2 HTTP/1.1\r\nHost: x\r\nContent-Length: 22\r\n\r\nGET /body HTTP/1.1\r\n\r\n"+
+		"POST /3 HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"+
+		"GET /4 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	var bodies []string
+	for _, r := range strings.Split(resp, "HTTP/1.1 ")[1:] {
+		if !strings.HasPrefix(r, "200 OK\r\n") {
+			t.Fatalf("response %q isn't a 200", r)
+		}
+		_, body := splitResponse(r)
+		bodies = append(bodies, body)
+	}
+	if got, want := strings.Join(bodies, ""), "GET /1;POST /2;POST /3;GET /4;"; got != want {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	// a socket file left behind by a server that didn't shut down
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	var logs syncBuffer
+	srv := NewServer("unix:"+path, HandlerFunc(func(resp *Response, req *Request) {
+		resp.Writef("%q", req.RemoteAddr)
+	}))
+	srv.Logger = log.New(&logs, "", 0)
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	b, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := splitResponse(string(b)); body != `""` {
+		t.Errorf("remote address = %s, want none", body)
+	}
+
+	srv.Shutdown()
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+	if !strings.Contains("\n"+logs.String(), "\n- \"GET / HTTP/1.1\" 200 ") {
+		t.Errorf("access log without a - for the remote address:\n%s", logs.String())
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Shutdown: %v", err)
+	}
+
+	// in use by another server
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := listen("unix:" + path); err == nil {
+		t.Error("listen on a socket in use: no error")
+	}
+}
+
+// syncBuffer is a bytes.Buffer for goroutines to write to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var logs syncBuffer
+	body := bytes.Repeat([]byte("x"), 32<<20) // more than the socket buffers hold
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteData(body)
+	}), func(srv *Server) {
+		srv.WriteTimeout = 100 * time.Millisecond
+		srv.Compress = false
+		srv.Logger = log.New(&logs, "", 0)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	// the response isn't read until the server gives up
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "failed to write response") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no write timeout logged:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "i/o timeout") {
+		t.Errorf("write failed with another error than a timeout:\n%s", logs.String())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _ := io.Copy(ioutil.Discard, conn)
+	if n >= int64(len(body)) {
+		t.Errorf("read %d bytes, the whole response after its timeout", n)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString(req.Path)
+	}), func(srv *Server) { srv.MaxRequestsPerConn = 3 })
+
+	var reqs string
+	for i := 1; i <= 5; i++ {
+		reqs += "GET /" + string(rune('0'+i)) + " HTTP/1.1\r\nHost: x\r\n\r\n"
+	}
+	// the connection is closed after the third response
+	resp := rawRequest(t, addr, reqs)
+	parts := strings.Split(resp, "HTTP/1.1 200 OK\r\n")[1:]
+	if len(parts) != 3 {
+		t.Fatalf("got %d responses, want 3:\n%s", len(parts), resp)
+	}
+	for i, p := range parts {
+		head, body := splitResponse(p)
+		if want := "/" + string(rune('1'+i)); body != want {
+			t.Errorf("response %d = %q, want %q", i, body, want)
+		}
+		connection := "keep-alive"
+		if i == 2 {
+			connection = "close"
+		}
+		if !strings.Contains(head, "Connection: "+connection+"\r\n") {
+			t.Errorf("response %d without Connection: %s:\n%s", i, connection, head)
+		}
+	}
+}
+
+// temporaryError is a net.Error a listener may fail with for a while, as on
+// running out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// errListener fails to accept with errs in turn and is closed after them.
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestServeAcceptErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	permanent := errors.New("permanent")
+	tests := []struct {
+		name string
+		errs []error
+		want error
+	}{
+		{"closed", nil, nil},
+		{"temporary errors retried", []error{temporaryError{}, temporaryError{}}, nil},
+		{"permanent error", []error{temporaryError{}, permanent}, permanent},
+	}
+	for _, tt := range tests {
+		srv := NewServer("", nil)
+		srv.Logger = log.New(ioutil.Discard, "", 0)
+		err := srv.Serve(&errListener{l, tt.errs})
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: Serve = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestServeListenerClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer("", nil)
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve = %v, want nil once the listener is closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return once the listener was closed")
+	}
+}
+
+// captureLogger records the messages of a server.
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *captureLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) has(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.HasPrefix(m, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	logger := &captureLogger{}
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		panic("boom")
+	}), func(srv *Server) { srv.Logger = logger })
+	rawRequest(t, addr, "GET /panic HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	for _, prefix := range []string{
+		"[INFO] starting server, listen on " + addr,
+		"[ERROR] failed to serve /panic: panic: boom",
+	} {
+		if !logger.has(prefix) {
+			t.Errorf("no message %q logged in %q", prefix, logger.msgs)
+		}
+	}
+
+	if got := (&Server{}).logger(); got != log.Default() {
+		t.Errorf("logger without a Logger = %v, want the standard logger", got)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	panicking := HandlerFunc(func(resp *Response, req *Request) { panic("boom") })
+	jsonErrors := func(resp *Response, req *Request, code int, err error) {
+		path := ""
+		if req != nil {
+			path = req.Path
+		}
+		resp.WriteStatus(code)
+		resp.WriteJSON(map[string]any{"code": code, "path": path})
+	}
+
+	tests := []struct {
+		name         string
+		errorHandler func(*Response, *Request, int, error)
+		req, status  string
+		body         string
+	}{
+		{"JSON bad request", jsonErrors, "BAD\r\n\r\n", "HTTP/1.1 400 Bad Request", `{"code":400,"path":""}`},
+		{"JSON panic", jsonErrors, "GET /p HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 500 Internal Server Error", `{"code":500,"path":"/p"}`},
+		{"default", nil, "BAD\r\n\r\n", "HTTP/1.1 400 Bad Request", "400 bad request\n"},
+		{"panicking", func(*Response, *Request, int, error) { panic("again") }, "BAD\r\n\r\n", "HTTP/1.1 400 Bad Request", ""},
+	}
+	for _, tt := range tests {
+		addr := startServer(t, panicking, func(srv *Server) { srv.ErrorHandler = tt.errorHandler })
+		resp := rawRequest(t, addr, tt.req)
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("%s: status line = %q, want %q", tt.name, got, tt.status)
+		}
+		if body != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+		if !strings.Contains(head, "\r\nConnection: close\r\n") {
+			t.Errorf("%s: no Connection: close:\n%s", tt.name, head)
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString("ok")
+	}), func(srv *Server) { srv.MaxConns = 1 })
+
+	// the first connection is kept alive, holding the only slot
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	first.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if resp, err := http.ReadResponse(bufio.NewReader(first), nil); err != nil || resp.Close {
+		t.Fatalf("first connection: %v, want it kept alive", err)
+	}
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	head, _ := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 503 Service Unavailable" {
+		t.Errorf("second connection: status line = %q, want a 503", got)
+	}
+	if !strings.Contains(head, "\r\nConnection: close\r\n") {
+		t.Errorf("second connection: no Connection: close:\n%s", head)
+	}
+
+	// the slot is released once the first connection is closed
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if statusLine(resp) == "HTTP/1.1 200 OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not reused after the first connection closed:\n%s", resp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		t.Errorf("request %s served", req.RequestURI)
+	}), func(srv *Server) { srv.ReadTimeout = 50 * time.Millisecond })
+
+	for _, partial := range []string{"GET / HT", "GET / HTTP/1.1\r\nHost: x\r\n"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(partial)) // the rest never comes
+		b, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", partial, err)
+		}
+		if got := statusLine(string(b)); got != "HTTP/1.1 408 Request Timeout" {
+			t.Errorf("%q: status line = %q, want a 408", partial, got)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	logger := &captureLogger{}
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteString("ok")
+	}), func(srv *Server) {
+		srv.Logger = logger
+		srv.ReadTimeout = 5 * time.Second
+		srv.IdleTimeout = 50 * time.Millisecond
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+
+	// well before ReadTimeout, the connection is closed without a word
+	start := time.Now()
+	b, err := ioutil.ReadAll(r)
+	if err != nil || len(b) > 0 {
+		t.Errorf("idle connection: read %q, %v, want it closed quietly", b, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection closed after %v", d)
+	}
+	if logger.has("[ERROR]") {
+		t.Errorf("error logged closing an idle connection: %q", logger.msgs)
+	}
+}
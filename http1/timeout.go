@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned reading the request body from a handler of
+// TimeoutHandler once it timed out.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// TimeoutHandler serves requests with h, replying with a 503 Service
+// Unavailable and msg if h hasn't returned within d. The request context of h
+// is canceled then for it to give up.
+//
+// h writes to a response of its own, copied once it returns in time, so that
+// whatever a late handler writes is dropped. Its body is sent as a whole: it
+// can't be streamed, nor the connection hijacked. The request body is cut off
+// after a timeout, reads failing with ErrHandlerTimeout, and the connection
+// is closed, the body being possibly left half read.
+func TimeoutHandler(h Handler, d time.Duration, msg string) Handler {
+	return HandlerFunc(func(resp *Response, req *Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		tb := &timeoutBody{ctx: ctx, b: req.body}
+		r2 := *req
+		r2.ctx = ctx
+		// a body of its own, for the late handler to leave req's alone
+		r2.body = &body{r: tb, n: -1}
+		r2.Body = r2.body
+		tr := &Response{req: &r2, srv: resp.srv} // no connection to stream to
+
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				for _, form := range r2.body.forms {
+					if err := form.RemoveAll(); err != nil {
+						resp.srv.errorLog("remove multipart files", err)
+					}
+				}
+			}()
+			defer func() {
+				if err := recover(); err != nil {
+					panicked <- handlerPanic{err, debug.Stack()}
+				}
+			}()
+			h.ServeHTTP(tr, &r2)
+			close(done)
+		}()
+
+		select {
+		case err := <-panicked:
+			panic(err) // for the server to recover from as for any handler
+		case <-done:
+			resp.status = tr.status
+			for k, v := range tr.header {
+				for _, vv := range v {
+					resp.WriteHeader(k, vv)
+				}
+			}
+			for k, v := range tr.trailer {
+				for _, vv := range v {
+					resp.SetTrailer(k, vv)
+				}
+			}
+			resp.WriteData(tr.data)
+		case <-ctx.Done():
+			tb.cutOff(resp.conn)
+			delete(resp.header, "Connection")
+			resp.WriteHeader("Connection", "close")
+			Error(resp, msg, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// handlerPanic is a panic of the handler of TimeoutHandler, raised again in
+// the goroutine serving the request along with the stack it was raised with,
+// which that goroutine's doesn't tell.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+func (p handlerPanic) String() string {
+	return fmt.Sprintf("%v\n\nhandler goroutine:\n%s", p.value, p.stack)
+}
+
+// timeoutBody is the request body read by a handler of TimeoutHandler, cut
+// off from b once the handler timed out.
+type timeoutBody struct {
+	mu       sync.Mutex // held while reading
+	ctx      context.Context
+	b        *body
+	timedOut bool
+}
+
+func (tb *timeoutBody) Read(p []byte) (int, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	// ctx is checked too, the handler seeing it done before cutOff is called
+	if tb.timedOut || tb.ctx.Err() != nil {
+		return 0, ErrHandlerTimeout
+	}
+	return tb.b.Read(p)
+}
+
+// cutOff stops the reads from b, the one in progress being made to give up
+// by the read deadline of conn, nil if unknown. The 100 Continue the client
+// may be waiting for is never sent.
+func (tb *timeoutBody) cutOff(conn net.Conn) {
+	if conn != nil {
+		// the connection is closed after the response, the deadline doesn't
+		// outlive the request
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.timedOut = true
+	tb.b.expect = nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	late := make(chan error, 1)
+	slow := HandlerFunc(func(resp *Response, req *Request) {
+		<-req.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		resp.WriteHeader("X-Late", "1")
+		resp.WriteString("late")
+		late <- req.Context().Err()
+	})
+	addr := startServer(t, TimeoutHandler(slow, 20*time.Millisecond, "too slow"), nil)
+
+	// no Connection: close, the server closes the connection itself
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	head, body := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 503 Service Unavailable" {
+		t.Errorf("status line = %q", got)
+	}
+	if !strings.Contains(head, "\r\nConnection: close\r\n") {
+		t.Errorf("no Connection: close:\n%s", head)
+	}
+	if strings.TrimSpace(body) != "too slow" {
+		t.Errorf("body = %q, want the message", body)
+	}
+	select {
+	case err := <-late:
+		if err == nil {
+			t.Error("the request context of the slow handler wasn't canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow handler never returned")
+	}
+	if strings.Contains(resp, "late") || strings.Contains(resp, "X-Late") {
+		t.Errorf("the late output was sent:\n%s", resp)
+	}
+}
+
+func TestTimeoutHandlerInTime(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		resp.WriteStatus(201)
+		resp.WriteHeader("X-Fast", "1")
+		resp.WriteString("fast")
+	})
+	addr := startServer(t, TimeoutHandler(h, 5*time.Second, "too slow"), nil)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	head, body := splitResponse(resp)
+	if got := statusLine(resp); got != "HTTP/1.1 201 Created" {
+		t.Errorf("status line = %q", got)
+	}
+	if !strings.Contains(head, "\r\nX-Fast: 1\r\n") {
+		t.Errorf("header not copied:\n%s", head)
+	}
+	if body != "fast" {
+		t.Errorf("body = %q, want %q", body, "fast")
+	}
+}
+
+func TestTimeoutHandlerBody(t *testing.T) {
+	readErr := make(chan error, 1)
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		<-req.Context().Done()
+		_, err := ioutil.ReadAll(req.Body)
+		readErr <- err
+	})
+	addr := startServer(t, TimeoutHandler(h, 20*time.Millisecond, "too slow"), nil)
+
+	resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello")
+	if got := statusLine(resp); got != "HTTP/1.1 503 Service Unavailable" {
+		t.Errorf("status line = %q", got)
+	}
+	select {
+	case err := <-readErr:
+		if err != ErrHandlerTimeout {
+			t.Errorf("read after the timeout: %v, want ErrHandlerTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler never returned")
+	}
+}
+
+// timeoutPanic is a handler of TimeoutHandler panicking.
+func timeoutPanic(resp *Response, req *Request) {
+	panic("timeout boom")
+}
+
+func TestTimeoutHandlerPanic(t *testing.T) {
+	logger := &captureLogger{}
+	addr := startServer(t, TimeoutHandler(HandlerFunc(timeoutPanic), 5*time.Second, "too slow"),
+		func(srv *Server) { srv.Logger = logger })
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if got := statusLine(resp); got != "HTTP/1.1 500 Internal Server Error" {
+		t.Errorf("status line = %q, want a 500", got)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, m := range logger.msgs {
+		if strings.Contains(m, "timeout boom") {
+			if !strings.Contains(m, ".timeoutPanic(") {
+				t.Errorf("logged stack doesn't name the handler:\n%s", m)
+			}
+			return
+		}
+	}
+	t.Errorf("panic not logged: %q", logger.msgs)
+}
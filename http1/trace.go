@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// traceHidden are the request headers a TRACE response leaves out, lest a
+// script reads credentials it isn't given otherwise (RFC 7231 section 4.3.8).
+var traceHidden = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// trace answers a TRACE request: with the request line and headers it was
+// received with as a message/http body when srv.Trace is set, with 405
+// Method Not Allowed otherwise. Reflecting requests is disabled by default as
+// it helps cross-site tracing (XST) attacks.
+func (srv *Server) trace(resp *Response, req *Request) {
+	if !srv.Trace {
+		methodNotAllowed(resp, http.MethodTrace)
+		return
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		if !traceHidden[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(req.Method + " " + req.RequestURI + " " + req.Proto + "\r\n")
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+
+	resp.WriteStatus(http.StatusOK)
+	resp.WriteHeader("Content-Type", "message/http")
+	resp.WriteString(b.String())
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	h := HandlerFunc(func(resp *Response, req *Request) {
+		t.Errorf("TRACE reached the handler")
+	})
+	const req = "TRACE /debug?a=1 HTTP/1.1\r\nHost: x\r\nX-Custom: value\r\nCookie: session=secret\r\nAuthorization: Basic c2VjcmV0\r\nConnection: close\r\n\r\n"
+
+	t.Run("disabled", func(t *testing.T) {
+		resp := rawRequest(t, startServer(t, h, nil), req)
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != "HTTP/1.1 405 Method Not Allowed" {
+			t.Errorf("status = %q, want 405", got)
+		}
+		// CONNECT isn't served either, the server not being a proxy
+		if !strings.Contains(head, "\r\nAllow: DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT\r\n") {
+			t.Errorf("no Allow of the methods served:\n%s", head)
+		}
+		if strings.Contains(body, "X-Custom") {
+			t.Errorf("request reflected: %q", body)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		resp := rawRequest(t, startServer(t, h, func(srv *Server) { srv.Trace = true }), req)
+		head, body := splitResponse(resp)
+		if got := statusLine(resp); got != "HTTP/1.1 200 OK" {
+			t.Errorf("status = %q, want 200", got)
+		}
+		if !strings.Contains(head, "\r\nContent-Type: message/http\r\n") {
+			t.Errorf("no message/http Content-Type:\n%s", head)
+		}
+		want := "TRACE /debug?a=1 HTTP/1.1\r\nConnection: close\r\nHost: x\r\nX-Custom: value\r\n\r\n"
+		if body != want {
+			t.Errorf("body = %q, want %q without credentials", body, want)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// websocketGUID is appended to the key of the client to compute the accept
+// value (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketAccept returns the Sec-WebSocket-Accept value answering the
+// Sec-WebSocket-Key key, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" for the
+// "dGhlIHNhbXBsZSBub25jZQ==" of the RFC.
+func WebSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsWebSocketUpgrade reports whether req asks to switch to the WebSocket
+// protocol.
+func IsWebSocketUpgrade(req *Request) bool {
+	return req.Method == http.MethodGet &&
+		req.hasConnectionToken("Upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// UpgradeWebSocket completes the WebSocket opening handshake of req and
+// hijacks the connection, the frames are then up to the caller. A request
+// that isn't a valid handshake is answered with 400 Bad Request, or 426
+// Upgrade Required when of a version other than 13.
+func UpgradeWebSocket(resp *Response, req *Request) (net.Conn, *bufio.ReadWriter, error) {
+	if !IsWebSocketUpgrade(req) || !req.ProtoAtLeast(1, 1) {
+		Error(resp, "400 bad request", http.StatusBadRequest)
+		return nil, nil, errors.New("not a WebSocket handshake")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		Error(resp, "400 bad request", http.StatusBadRequest)
+		return nil, nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		resp.WriteHeader("Sec-WebSocket-Version", "13")
+		resp.WriteHeader("Upgrade", "websocket")
+		Error(resp, "426 upgrade required", http.StatusUpgradeRequired)
+		return nil, nil, errors.New("unsupported WebSocket version")
+	}
+
+	conn, rw, err := resp.Hijack()
+	if err != nil {
+		Error(resp, "500 internal server error", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + WebSocketAccept(key) + "\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
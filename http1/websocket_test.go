@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// the example of RFC 6455 section 1.3
+	if got, want := WebSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("WebSocketAccept = %q, want %q", got, want)
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	addr := startServer(t, HandlerFunc(func(resp *Response, req *Request) {
+		conn, rw, err := UpgradeWebSocket(resp, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// frames are out of scope, the hijacked connection echoes a line
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}), nil)
+
+	const handshake = "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(handshake + "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read the handshake: %v", err)
+		}
+		if head.WriteString(line); line == "\r\n" {
+			break
+		}
+	}
+	want := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+	if head.String() != want {
+		t.Fatalf("handshake = %q, want %q", head.String(), want)
+	}
+	conn.Write([]byte("hello\n"))
+	if line, err := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("read %q, %v over the hijacked connection, want hello", line, err)
+	}
+
+	tests := []struct {
+		name, header, status string
+	}{
+		{"invalid key", "Sec-WebSocket-Key: short\r\nSec-WebSocket-Version: 13\r\n", "HTTP/1.1 400 Bad Request"},
+		{"other version", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n", "HTTP/1.1 426 Upgrade Required"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, strings.Replace(handshake, "keep-alive", "close", 1)+tt.header+"\r\n")
+		if got := statusLine(resp); got != tt.status {
+			t.Errorf("%s: status = %q, want %q", tt.name, got, tt.status)
+		}
+	}
+	if got := statusLine(rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")); got != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("no upgrade: status = %q, want 400", got)
+	}
+}